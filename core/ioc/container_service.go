@@ -1,14 +1,50 @@
 package ioc
 
-import "net/url"
+import (
+	"errors"
+	"net/url"
+)
+
+// ErrVersionUnavailable means the PocketBase version an instance asks for
+// can't be run on this machine
+var ErrVersionUnavailable = errors.New("pocketbase version unavailable")
 
 type IContainer interface {
 	Url() *url.URL
+	// Deployment is the deployment the container was launched from
+	Deployment() IDeployment
+	// Release marks the end of a request served by the container
+	Release()
+	// Status reports how the container is doing
+	Status() ContainerStatus
+}
+
+// ContainerStatus is a snapshot of how a container is doing. Providers that
+// don't restart or limit containers leave those fields zero.
+type ContainerStatus struct {
+	Running bool
+	// Restarts counts processes restarted after a crash
+	Restarts int
+	// OomKills counts processes killed for going over the memory limit
+	OomKills int
+	// MemoryMax is the memory limit in bytes, and Cpus how many CPUs' worth
+	// of time the container may use. Zero means no limit.
+	MemoryMax int64
+	Cpus      float64
 }
 
 type IContainerService interface {
 	IService
+	// GetOrCreateContainer returns a running container for the deployment.
+	// The caller must Release it once the request is done.
 	GetOrCreateContainer(deployment IDeployment) (IContainer, error)
+	// GetContainer returns the running container for an instance, if any
+	GetContainer(instanceId string) (IContainer, bool)
+	// StopContainer stops and forgets an instance's container. It reports
+	// whether there was one to stop.
+	StopContainer(instanceId string) bool
+	// ContainerIds lists the instances that have a container
+	ContainerIds() []string
 }
 
 func RegisterContainerService(provider IContainerService) {
@@ -1,5 +1,13 @@
 package ioc
 
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
+var ErrDeploymentNotFound = errors.New("deployment not found")
+
 type IDeploymentService interface {
 	GetDeploymentByHost(host string) (IDeployment, error)
 	Start()
@@ -8,6 +16,9 @@ type IDeploymentService interface {
 type IDeployment interface {
 	IsLegacy() bool
 	InstanceId() string
+	// Subdomain is the instance's own subdomain, whichever host the request
+	// was routed by
+	Subdomain() string
 	MachineId() string
 	IsUserVerified() bool
 	IsUserSuspended() bool
@@ -15,6 +26,14 @@ type IDeployment interface {
 	IsInstancePoweredOn() bool
 	InstanceSuspendedReason() string
 	UserSuspendedReason() string
+	PrivateUrl() *url.URL
+	IdleTtl() time.Duration
+	// Subscription is the owning user's subscription tier
+	Subscription() string
+	// Version is the PocketBase version the instance asks for
+	Version() string
+	// Secrets are the instance's environment secrets
+	Secrets() map[string]string
 }
 
 type IDeploymentContainer interface {
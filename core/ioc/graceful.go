@@ -0,0 +1,58 @@
+package ioc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// IGracefulService is implemented by services that hold resources which must
+// be released before the process exits
+type IGracefulService interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Shutdown shuts down every registered service that supports it, in
+// parallel. It returns once they are all done, or as soon as ctx expires,
+// leaving the stragglers to finish in the background.
+func (c *IoCContainer) Shutdown(ctx context.Context) error {
+	mu := sync.Mutex{}
+	errs := []error{}
+	wg := sync.WaitGroup{}
+
+	c.services.Range(func(name string, service IService) bool {
+		graceful, ok := service.(IGracefulService)
+		if !ok {
+			return true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := graceful.Shutdown(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mu.Unlock()
+			}
+		}()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		errs = append(errs, fmt.Errorf("services still stopping: %w", ctx.Err()))
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,36 @@
+package ioc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type stuckService struct{}
+
+func (stuckService) Start() {}
+
+func (stuckService) Shutdown(ctx context.Context) error {
+	select {}
+}
+
+func TestShutdownReturnsWhenContextExpires(t *testing.T) {
+	c := &IoCContainer{}
+	c.Register("stuck", stuckService{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	returned := make(chan error)
+	go func() { returned <- c.Shutdown(ctx) }()
+
+	select {
+	case err := <-returned:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown() error = %v, want DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown() did not return after ctx expired")
+	}
+}
@@ -4,8 +4,8 @@ import "pocker/core/syncx"
 
 type IInstance interface {
 	syncx.IIndexedCacheItem
-	UserId() string
-	MachineId() string
+	GetUserId() string
+	GetMachineId() string
 }
 
 type IUser interface {
@@ -14,11 +14,27 @@ type IUser interface {
 
 type IMachine interface {
 	syncx.IIndexedCacheItem
+	GetPrivateUrl() string
 }
 
 type IMothershipService interface {
 	IService
 	GetDeploymentByIdentifier(identifier string) (IDeployment, error)
+	GetDeploymentByInstanceId(instanceId string) (IDeployment, error)
+	GetInstanceById(id string) (IInstance, error)
+	GetInstanceBySubdomain(subdomain string) (IInstance, error)
+	GetInstanceByCname(cname string) (IInstance, error)
+	// GetInstancesByUserId returns every instance a user owns, which may be
+	// none
+	GetInstancesByUserId(userId string) []IInstance
+	GetUserById(id string) (IUser, error)
+	GetMachineByUuid(uuid string) (IMachine, error)
+	// OnInstanceChange registers fn to be called with the action ("create",
+	// "update" or "delete") and id of every instance the mirror changes
+	OnInstanceChange(fn func(action string, instanceId string))
+	// OnUserChange registers fn to be called with the action and id of every
+	// user the mirror changes
+	OnUserChange(fn func(action string, userId string))
 }
 
 func RegisterMothershipService(provider IMothershipService) {
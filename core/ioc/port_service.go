@@ -3,6 +3,7 @@ package ioc
 type IPortService interface {
 	IService
 	AllocatePort() (int, error)
+	ReleasePort(port int)
 }
 
 func RegisterPortService(provider IPortService) {
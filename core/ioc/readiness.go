@@ -0,0 +1,71 @@
+package ioc
+
+import (
+	"context"
+	"sync"
+)
+
+// ReadinessCheck reports whether one dependency of the machine is able to
+// serve traffic. A failing Required check makes the whole machine not ready;
+// other checks are only reported.
+type ReadinessCheck struct {
+	Name     string
+	Required bool
+	Check    func(ctx context.Context) error
+}
+
+type ReadinessResult struct {
+	Ok       bool   `json:"ok"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+}
+
+// IReadinessService is implemented by services that contribute readiness
+// checks
+type IReadinessService interface {
+	ReadinessChecks() []ReadinessCheck
+}
+
+// ReadinessChecks collects the checks of every registered service
+func (c *IoCContainer) ReadinessChecks() []ReadinessCheck {
+	checks := []ReadinessCheck{}
+	c.services.Range(func(name string, service IService) bool {
+		if readiness, ok := service.(IReadinessService); ok {
+			checks = append(checks, readiness.ReadinessChecks()...)
+		}
+		return true
+	})
+	return checks
+}
+
+// RunReadinessChecks runs checks in parallel and reports whether every
+// required one passed
+func RunReadinessChecks(ctx context.Context, checks []ReadinessCheck) (bool, map[string]ReadinessResult) {
+	mu := sync.Mutex{}
+	results := map[string]ReadinessResult{}
+	wg := sync.WaitGroup{}
+
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := ReadinessResult{Ok: true, Required: check.Required}
+			if err := check.Check(ctx); err != nil {
+				result.Ok = false
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			results[check.Name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	ready := true
+	for _, result := range results {
+		if result.Required && !result.Ok {
+			ready = false
+		}
+	}
+	return ready, results
+}
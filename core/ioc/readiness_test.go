@@ -0,0 +1,68 @@
+package ioc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunReadinessChecks(t *testing.T) {
+	pass := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("down") }
+
+	tests := []struct {
+		name      string
+		checks    []ReadinessCheck
+		wantReady bool
+	}{
+		{
+			name:      "no checks",
+			wantReady: true,
+		},
+		{
+			name: "all passing",
+			checks: []ReadinessCheck{
+				{Name: "a", Required: true, Check: pass},
+				{Name: "b", Required: false, Check: pass},
+			},
+			wantReady: true,
+		},
+		{
+			name: "optional failing",
+			checks: []ReadinessCheck{
+				{Name: "a", Required: true, Check: pass},
+				{Name: "b", Required: false, Check: fail},
+			},
+			wantReady: true,
+		},
+		{
+			name: "required failing",
+			checks: []ReadinessCheck{
+				{Name: "a", Required: true, Check: fail},
+				{Name: "b", Required: false, Check: pass},
+			},
+			wantReady: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready, results := RunReadinessChecks(context.Background(), tt.checks)
+			if ready != tt.wantReady {
+				t.Errorf("RunReadinessChecks() ready = %v, want %v", ready, tt.wantReady)
+			}
+			if len(results) != len(tt.checks) {
+				t.Errorf("RunReadinessChecks() returned %d results, want %d", len(results), len(tt.checks))
+			}
+			for _, check := range tt.checks {
+				result := results[check.Name]
+				if result.Required != check.Required {
+					t.Errorf("result %s required = %v, want %v", check.Name, result.Required, check.Required)
+				}
+				if !result.Ok && result.Error == "" {
+					t.Errorf("failed result %s has no error", check.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+// Package metrics is a minimal Prometheus text exposition registry covering
+// the counters, histograms and gauges Pocker reports on /x/metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry served on /x/metrics. Metrics created with the
+// package-level constructors register themselves here.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// DefaultBuckets suit request latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ================================================
+// Counters
+// ================================================
+
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return newCounterVec(Default, name, help, labelNames...)
+}
+
+func newCounterVec(registry *Registry, name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		series:     map[string]*counterSeries{},
+	}
+	registry.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if !checkLabels(c.name, c.labelNames, labelValues) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(labelValues)
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{labelValues: labelValues}
+		c.series[key] = series
+	}
+	series.value += value
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		series := c.series[key]
+		writeSample(w, c.name, c.labelNames, series.labelValues, nil, series.value)
+	}
+}
+
+// ================================================
+// Histograms
+// ================================================
+
+type HistogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return newHistogramVec(Default, name, help, buckets, labelNames...)
+}
+
+func newHistogramVec(registry *Registry, name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     map[string]*histogramSeries{},
+	}
+	registry.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if !checkLabels(h.name, h.labelNames, labelValues) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(labelValues)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = series
+	}
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i, upperBound := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labelNames, series.labelValues, []string{"le", formatFloat(upperBound)}, float64(series.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labelNames, series.labelValues, []string{"le", "+Inf"}, float64(series.count))
+		writeSample(w, h.name+"_sum", h.labelNames, series.labelValues, nil, series.sum)
+		writeSample(w, h.name+"_count", h.labelNames, series.labelValues, nil, float64(series.count))
+	}
+}
+
+// ================================================
+// Gauges, read at scrape time
+// ================================================
+
+type gaugeFunc struct {
+	name      string
+	help      string
+	labelName string
+	fn        func() map[string]float64
+}
+
+// NewGaugeFunc reports the value returned by fn on every scrape
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	Default.register(&gaugeFunc{
+		name: name,
+		help: help,
+		fn: func() map[string]float64 {
+			return map[string]float64{"": fn()}
+		},
+	})
+}
+
+// NewGaugeVecFunc reports one series per key returned by fn, labelled with
+// labelName
+func NewGaugeVecFunc(name string, help string, labelName string, fn func() map[string]float64) {
+	Default.register(&gaugeFunc{
+		name:      name,
+		help:      help,
+		labelName: labelName,
+		fn:        fn,
+	})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.fn()
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(values) {
+		if g.labelName == "" {
+			writeSample(w, g.name, nil, nil, nil, values[key])
+			continue
+		}
+		writeSample(w, g.name, []string{g.labelName}, []string{key}, nil, values[key])
+	}
+}
+
+// ================================================
+// Text format helpers
+// ================================================
+
+// checkLabels reports whether a metric was given as many label values as it
+// has labels. Samples that weren't are logged and dropped rather than written
+// with empty labels; metrics are recorded on the request path, where a panic
+// would fail the request.
+func checkLabels(name string, labelNames []string, labelValues []string) bool {
+	if len(labelValues) != len(labelNames) {
+		slog.Error("Dropped metric sample with the wrong number of label values",
+			"metric", name,
+			"labels", labelNames,
+			"values", labelValues)
+		return false
+	}
+	return true
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeSample(w io.Writer, name string, labelNames []string, labelValues []string, extra []string, value float64) {
+	pairs := []string{}
+	for i, labelName := range labelNames {
+		labelValue := ""
+		if i < len(labelValues) {
+			labelValue = labelValues[i]
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escapeLabel(labelValue)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
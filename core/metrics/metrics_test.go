@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec_Write(t *testing.T) {
+	registry := NewRegistry()
+	counter := newCounterVec(registry, "test_requests_total", "Test requests", "route")
+	counter.Inc("local")
+	counter.Inc("local")
+	counter.Inc(`le"gacy`)
+
+	buf := bytes.Buffer{}
+	registry.Write(&buf)
+
+	want := `# HELP test_requests_total Test requests
+# TYPE test_requests_total counter
+test_requests_total{route="le\"gacy"} 1
+test_requests_total{route="local"} 2
+`
+	if buf.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramVec_Write(t *testing.T) {
+	registry := NewRegistry()
+	histogram := newHistogramVec(registry, "test_duration_seconds", "Test durations", []float64{0.1, 1}, "route")
+	histogram.Observe(0.05, "local")
+	histogram.Observe(0.5, "local")
+	histogram.Observe(5, "local")
+
+	buf := bytes.Buffer{}
+	registry.Write(&buf)
+	got := buf.String()
+
+	for _, line := range []string{
+		`test_duration_seconds_bucket{route="local",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="local",le="1"} 2`,
+		`test_duration_seconds_bucket{route="local",le="+Inf"} 3`,
+		`test_duration_seconds_sum{route="local"} 5.55`,
+		`test_duration_seconds_count{route="local"} 3`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Write() missing %q in\n%s", line, got)
+		}
+	}
+}
+
+func TestGaugeFunc_Write(t *testing.T) {
+	registry := NewRegistry()
+	registry.register(&gaugeFunc{
+		name:      "test_records",
+		help:      "Test records",
+		labelName: "collection",
+		fn: func() map[string]float64 {
+			return map[string]float64{"users": 2, "instances": 3}
+		},
+	})
+
+	buf := bytes.Buffer{}
+	registry.Write(&buf)
+
+	want := `# HELP test_records Test records
+# TYPE test_records gauge
+test_records{collection="instances"} 3
+test_records{collection="users"} 2
+`
+	if buf.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWrongLabelCountIsDropped(t *testing.T) {
+	registry := NewRegistry()
+	counter := newCounterVec(registry, "test_errors_total", "Test errors", "upstream", "reason")
+	histogram := newHistogramVec(registry, "test_duration_seconds", "Test durations", nil, "route")
+
+	counter.Inc("legacy")
+	histogram.Observe(1, "local", "extra")
+
+	buf := bytes.Buffer{}
+	registry.Write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			t.Errorf("Write() has sample %q from the wrong number of label values", line)
+		}
+	}
+}
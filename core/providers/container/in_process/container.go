@@ -3,27 +3,43 @@ package in_process
 import (
 	"net/url"
 	"pocker/core/ioc"
-	"sync"
-	"sync/atomic"
+	"pocker/core/providers/container/registry"
 
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
 )
 
 var _ ioc.IContainer = (*Container)(nil)
 
 type Container struct {
-	initOnce   sync.Once
-	err        atomic.Value
-	app        *pocketbase.PocketBase
-	port       int
-	url        *url.URL
-	deployment ioc.IDeployment
+	*registry.Lifecycle
+	app  *pocketbase.PocketBase
+	port int
+	url  *url.URL
+}
+
+func newContainer(deployment ioc.IDeployment) *Container {
+	return &Container{
+		Lifecycle: registry.NewLifecycle(deployment),
+	}
 }
 
 func (c *Container) Url() *url.URL {
 	return c.url
 }
 
-func (c *Container) Deployment() ioc.IDeployment {
-	return c.deployment
+// Status only reports whether the container is running. In-process
+// containers are neither restarted nor limited.
+func (c *Container) Status() ioc.ContainerStatus {
+	return ioc.ContainerStatus{Running: c.Running()}
+}
+
+// stop triggers PocketBase's terminate hooks, which gracefully shut down the
+// HTTP server and close the app's databases
+func (c *Container) stop() error {
+	event := new(core.TerminateEvent)
+	event.App = c.app
+	return c.app.OnTerminate().Trigger(event, func(e *core.TerminateEvent) error {
+		return e.App.ResetBootstrapState()
+	})
 }
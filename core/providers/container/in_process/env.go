@@ -0,0 +1,56 @@
+package in_process
+
+import (
+	"maps"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// bindInstanceEnv gives an app's JS VMs their instance's secrets as their
+// whole environment. $os.getenv and process.env would otherwise read the
+// Pocker process environment, which is shared by every tenant and holds
+// Pocker's own credentials, and commands started with $os.cmd or $os.exec
+// would inherit it.
+//
+// This doesn't make the environment private: hooks run inside Pocker, so
+// they can still read it from /proc/self/environ. Tenants that mustn't see
+// Pocker's credentials need the subprocess provider.
+func bindInstanceEnv(vm *goja.Runtime, secrets map[string]string) {
+	env := maps.Clone(secrets)
+	if env == nil {
+		env = map[string]string{}
+	}
+	environ := instanceEnviron(env)
+	command := func(name string, args ...string) *exec.Cmd {
+		cmd := exec.Command(name, args...)
+		cmd.Env = environ
+		return cmd
+	}
+
+	if osBinds, ok := vm.Get("$os").(*goja.Object); ok {
+		osBinds.Set("getenv", func(key string) string {
+			return env[key]
+		})
+		osBinds.Set("cmd", command)
+		osBinds.Set("exec", command)
+	}
+	if process, ok := vm.Get("process").(*goja.Object); ok {
+		process.Set("env", maps.Clone(env))
+	}
+}
+
+// instanceEnviron turns the secrets into KEY=value pairs for child processes
+func instanceEnviron(env map[string]string) []string {
+	environ := make([]string, 0, len(env))
+	for key, value := range env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			continue
+		}
+		environ = append(environ, key+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
@@ -0,0 +1,77 @@
+package in_process
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// newHookVm sets up $os and process the way jsvm does before calling OnInit,
+// reading and passing on the Pocker process environment
+func newHookVm() *goja.Runtime {
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.UncapFieldNameMapper())
+
+	osBinds := vm.NewObject()
+	osBinds.Set("getenv", os.Getenv)
+	osBinds.Set("cmd", exec.Command)
+	osBinds.Set("exec", exec.Command)
+	vm.Set("$os", osBinds)
+
+	env := map[string]string{}
+	for _, pair := range os.Environ() {
+		key, value, _ := strings.Cut(pair, "=")
+		env[key] = value
+	}
+	process := vm.NewObject()
+	process.Set("env", env)
+	vm.Set("process", process)
+	return vm
+}
+
+func TestHooksOnlySeeInstanceEnv(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run commands with")
+	}
+	t.Setenv("POCKER_TEST_CREDENTIAL", "pocker")
+
+	vm := newHookVm()
+	bindInstanceEnv(vm, map[string]string{"TENANT_KEY": "tenant"})
+
+	scripts := map[string]string{
+		`$os.getenv("TENANT_KEY")`:                 "tenant",
+		`$os.getenv("POCKER_TEST_CREDENTIAL")`:     "",
+		`process.env.TENANT_KEY`:                   "tenant",
+		`process.env.POCKER_TEST_CREDENTIAL || ""`: "",
+		`String.fromCharCode(...$os.cmd("sh", "-c", "printf %s \"$TENANT_KEY/$POCKER_TEST_CREDENTIAL\"").output())`:  "tenant/",
+		`String.fromCharCode(...$os.exec("sh", "-c", "printf %s \"$TENANT_KEY/$POCKER_TEST_CREDENTIAL\"").output())`: "tenant/",
+	}
+	for script, want := range scripts {
+		got, err := vm.RunString(script)
+		if err != nil {
+			t.Errorf("%s: %v", script, err)
+			continue
+		}
+		if got.String() != want {
+			t.Errorf("%s = %q, want %q", script, got.String(), want)
+		}
+	}
+}
+
+func TestHooksWithoutSecretsGetEmptyEnv(t *testing.T) {
+	t.Setenv("POCKER_TEST_CREDENTIAL", "pocker")
+
+	vm := newHookVm()
+	bindInstanceEnv(vm, nil)
+
+	got, err := vm.RunString(`Object.keys(process.env).length + ":" + $os.getenv("POCKER_TEST_CREDENTIAL")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "0:" {
+		t.Errorf("env = %q, want none", got.String())
+	}
+}
@@ -1,6 +1,7 @@
 package in_process
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -8,10 +9,11 @@ import (
 	"os"
 	"path/filepath"
 	"pocker/core/ioc"
-	"pocker/core/syncx"
+	"pocker/core/providers/container/registry"
 	"sync"
-	"sync/atomic"
+	"time"
 
+	"github.com/dop251/goja"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
@@ -20,25 +22,41 @@ import (
 )
 
 var _ ioc.IContainerService = (*ContainerService)(nil)
+var _ ioc.IGracefulService = (*ContainerService)(nil)
+var _ ioc.IReadinessService = (*ContainerService)(nil)
 
 type ContainerService struct {
-	initOnce        sync.Once
-	containers      syncx.Map[string, *Container]
-	containersCount atomic.Int32
-	config          ContainerProviderConfig
+	initOnce   sync.Once
+	containers *registry.Registry[*Container]
+	config     ContainerProviderConfig
 }
 
 type ContainerProviderConfig struct {
 	DataRoot string
 	DevMode  bool
+	// DefaultIdleTtl applies to instances that don't set their own idleTtl
+	DefaultIdleTtl time.Duration
+	ReapInterval   time.Duration
 }
 
 func New(config ContainerProviderConfig) *ContainerService {
 	provider := ContainerService{
-		containers:      syncx.Map[string, *Container]{},
-		containersCount: atomic.Int32{},
-		config:          config,
+		config: config,
 	}
+	provider.containers = registry.New(registry.RegistryConfig[*Container]{
+		New:    newContainer,
+		Launch: provider.launch,
+		Stop: func(container *Container) error {
+			return container.stop()
+		},
+		Cleanup: func(container *Container) {
+			if container.port != 0 {
+				ioc.Port().ReleasePort(container.port)
+			}
+		},
+		DefaultIdleTtl: config.DefaultIdleTtl,
+		ReapInterval:   config.ReapInterval,
+	})
 
 	return &provider
 }
@@ -49,117 +67,151 @@ func ensureDir(path string) error {
 }
 
 func (sm *ContainerService) GetOrCreateContainer(deployment ioc.IDeployment) (ioc.IContainer, error) {
-	slog.Debug("Currently cached instances",
-		"count", sm.containersCount.Load())
+	container, err := sm.containers.GetOrCreate(deployment)
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
+}
 
-	container, _ := sm.containers.LoadOrStore(deployment.InstanceId(), &Container{
-		initOnce:   sync.Once{},
-		err:        atomic.Value{},
-		deployment: deployment,
-	})
-	container.initOnce.Do(func() {
-		defer func() {
-			err := recover()
-			if err != nil {
-				container.err.Store(fmt.Errorf("failed to initialize container %s: %v", deployment.InstanceId(), err))
-				sm.containers.Delete(deployment.InstanceId())
-			}
-			sm.containersCount.Add(1)
-		}()
+// launch starts the container's PocketBase app on a port of its own
+func (sm *ContainerService) launch(container *Container) error {
+	deployment := container.Deployment()
 
-		port, err := ioc.Port().AllocatePort()
-		if err != nil {
-			panic(fmt.Errorf("failed to allocate port: %w", err))
-		}
+	port, err := ioc.Port().AllocatePort()
+	if err != nil {
+		return fmt.Errorf("failed to allocate port: %w", err)
+	}
+	container.port = port
 
-		// Ensure subdomain directory exists
-		instanceDir := sm.dataDir(deployment.InstanceId())
-		if err := ensureDir(instanceDir); err != nil {
-			panic(fmt.Errorf("failed to create instance directory: %w", err))
-		}
+	// Ensure subdomain directory exists
+	instanceDir := sm.dataDir(deployment.InstanceId())
+	if err := ensureDir(instanceDir); err != nil {
+		return fmt.Errorf("failed to create instance directory: %w", err)
+	}
 
-		// Create new PocketBase instance
-		app := pocketbase.NewWithConfig(pocketbase.Config{
-			HideStartBanner: true,
-			DefaultDev:      sm.config.DevMode,
-			DefaultDataDir:  filepath.Join(instanceDir, "pb_data"),
-		})
+	// Create new PocketBase instance
+	app := pocketbase.NewWithConfig(pocketbase.Config{
+		HideStartBanner: true,
+		DefaultDev:      sm.config.DevMode,
+		DefaultDataDir:  filepath.Join(instanceDir, "pb_data"),
+	})
 
-		// Register jsvm plugin
-		jsvm.MustRegister(app, jsvm.Config{
-			MigrationsDir: filepath.Join(instanceDir, "pb_migrations"),
-			HooksDir:      filepath.Join(instanceDir, "pb_hooks"),
-			HooksWatch:    true,
-		})
+	// Register jsvm plugin
+	jsvm.MustRegister(app, jsvm.Config{
+		MigrationsDir: filepath.Join(instanceDir, "pb_migrations"),
+		HooksDir:      filepath.Join(instanceDir, "pb_hooks"),
+		HooksWatch:    true,
+		OnInit: func(vm *goja.Runtime) {
+			bindInstanceEnv(vm, deployment.Secrets())
+		},
+	})
 
-		// static route to serves files from the provided public dir
-		// (if publicDir exists and the route path is not already defined)
-		publicDir := filepath.Join(instanceDir, "pb_public")
-		indexFallback := true
-		app.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
-			Func: func(e *core.ServeEvent) error {
-				if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
-					e.Router.GET("/{path...}", apis.Static(os.DirFS(publicDir), indexFallback))
-				}
-
-				return e.Next()
-			},
-			Priority: 999, // execute as latest as possible to allow users to provide their own route
-		})
+	// static route to serves files from the provided public dir
+	// (if publicDir exists and the route path is not already defined)
+	publicDir := filepath.Join(instanceDir, "pb_public")
+	indexFallback := true
+	app.OnServe().Bind(&hook.Handler[*core.ServeEvent]{
+		Func: func(e *core.ServeEvent) error {
+			if !e.Router.HasRoute(http.MethodGet, "/{path...}") {
+				e.Router.GET("/{path...}", apis.Static(os.DirFS(publicDir), indexFallback))
+			}
 
-		// Start the PocketBase instance
-		startError := make(chan error)
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					slog.Error("Recovered from panic in server",
-						"instance_id", deployment.InstanceId(),
-						"error", r)
-				}
-			}()
-
-			app.OnServe().BindFunc(func(e *core.ServeEvent) error {
-				e.Next()
-				startError <- nil
-				return nil
-			})
-			if err := app.Serve(port); err != nil {
-				startError <- err
-				slog.Error("Failed to start server",
+			return e.Next()
+		},
+		Priority: 999, // execute as latest as possible to allow users to provide their own route
+	})
+
+	// Start the PocketBase instance
+	startError := make(chan error, 1)
+	reportStart := func(err error) {
+		select {
+		case startError <- err:
+		default:
+		}
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Recovered from panic in server",
 					"instance_id", deployment.InstanceId(),
-					"error", err)
+					"error", r)
+				reportStart(fmt.Errorf("server panicked: %v", r))
 			}
-
-			// Delete the container from the map if it exists
-			sm.containers.Delete(deployment.InstanceId())
 		}()
 
-		err, ok := <-startError
-		if !ok {
-			panic(fmt.Errorf("failed to start server %s: %v", deployment.InstanceId(), err))
+		app.OnServe().BindFunc(func(e *core.ServeEvent) error {
+			if err := e.Next(); err != nil {
+				return err
+			}
+			reportStart(nil)
+			return nil
+		})
+		if err := app.Serve(port); err != nil {
+			reportStart(err)
+			slog.Error("Failed to start server",
+				"instance_id", deployment.InstanceId(),
+				"error", err)
 		}
 
-		slog.Debug("Server started",
-			"instance_id", deployment.InstanceId(),
-			"port", port)
+		// Forget the container and give its port back
+		sm.containers.Evict(container)
+	}()
 
-		container.app = app
-		container.port = port
-		container.url = &url.URL{
-			Scheme: "http",
-			Host:   fmt.Sprintf("localhost:%d", port),
-		}
-	})
+	if err := <-startError; err != nil {
+		return fmt.Errorf("failed to start server %s: %w", deployment.InstanceId(), err)
+	}
+
+	slog.Debug("Server started",
+		"instance_id", deployment.InstanceId(),
+		"port", port)
+
+	container.app = app
+	container.url = &url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("localhost:%d", port),
+	}
+	return nil
+}
 
-	if container.err.Load() != nil {
-		return nil, container.err.Load().(error)
+func (sm *ContainerService) GetContainer(instanceId string) (ioc.IContainer, bool) {
+	container, ok := sm.containers.Get(instanceId)
+	if !ok {
+		return nil, false
 	}
+	return container, true
+}
 
-	return container, nil
+func (sm *ContainerService) ContainerIds() []string {
+	return sm.containers.Ids()
 }
 
+// StopContainer stops an instance's container right away, even if it is
+// serving requests. The next request launches a fresh one.
+func (sm *ContainerService) StopContainer(instanceId string) bool {
+	return sm.containers.Stop(instanceId)
+}
+
+// Start creates the data root but never clears it. It holds every
+// instance's pb_data, which has to survive deploys and reboots.
 func (sm *ContainerService) Start() {
-	sm.initOnce.Do(sm.cleanupDataDir)
+	sm.initOnce.Do(func() {
+		if err := ensureDir(sm.dataDir()); err != nil {
+			slog.Error("Failed to create data directory",
+				"path", sm.dataDir(),
+				"error", err)
+		}
+		sm.containers.Start()
+	})
+}
+
+func (sm *ContainerService) ReadinessChecks() []ioc.ReadinessCheck {
+	return []ioc.ReadinessCheck{sm.containers.ReadinessCheck()}
+}
+
+// Shutdown stops every running container, giving up when ctx expires
+func (sm *ContainerService) Shutdown(ctx context.Context) error {
+	return sm.containers.Shutdown(ctx)
 }
 
 func (sm *ContainerService) dataDir(paths ...string) string {
@@ -169,29 +221,3 @@ func (sm *ContainerService) dataDir(paths ...string) string {
 	}
 	return abs
 }
-
-func (sm *ContainerService) cleanupDataDir() {
-	// Delete all subdirectories in data dir
-
-	if err := os.MkdirAll(sm.dataDir(), 0755); err != nil {
-		slog.Error("Failed to create data directory",
-			"error", err)
-	}
-
-	// List and log subdirectories before deletion
-	if entries, err := os.ReadDir(sm.dataDir()); err == nil {
-		for _, entry := range entries {
-			if entry.IsDir() {
-				subdomainDir, err := filepath.Abs(filepath.Join(sm.dataDir(), entry.Name()))
-				if err != nil {
-					slog.Error("Failed to get absolute path for subdirectory",
-						"error", err)
-					continue
-				}
-				slog.Debug("Deleting subdirectory",
-					"path", subdomainDir)
-				os.RemoveAll(subdomainDir)
-			}
-		}
-	}
-}
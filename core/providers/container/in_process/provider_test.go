@@ -0,0 +1,27 @@
+package in_process
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartKeepsInstanceData(t *testing.T) {
+	root := t.TempDir()
+	data := filepath.Join(root, "instance", "pb_data", "data.db")
+	if err := os.MkdirAll(filepath.Dir(data), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(data, []byte("tenant data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := New(ContainerProviderConfig{DataRoot: root})
+	sm.Start()
+	defer sm.Shutdown(context.Background())
+
+	if _, err := os.Stat(data); err != nil {
+		t.Errorf("instance data gone after Start: %v", err)
+	}
+}
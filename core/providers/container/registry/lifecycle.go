@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"pocker/core/ioc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle is the state a Registry keeps for each container. Providers
+// embed it in their container type.
+type Lifecycle struct {
+	deployment ioc.IDeployment
+
+	initOnce    sync.Once
+	err         error
+	running     atomic.Bool
+	evictOnce   sync.Once
+	lastRequest atomic.Int64
+
+	// mu guards inflight and stopping, so deciding that a container is idle
+	// and marking it stopping can't interleave with a request acquiring it.
+	// It also orders a launch finishing against an eviction.
+	mu       sync.Mutex
+	inflight int
+	stopping bool
+	gone     bool
+	// evicted is closed once the container has been removed from the
+	// registry
+	evicted chan struct{}
+}
+
+func NewLifecycle(deployment ioc.IDeployment) *Lifecycle {
+	return &Lifecycle{
+		deployment: deployment,
+		evicted:    make(chan struct{}),
+	}
+}
+
+func (l *Lifecycle) lifecycle() *Lifecycle {
+	return l
+}
+
+func (l *Lifecycle) Deployment() ioc.IDeployment {
+	return l.deployment
+}
+
+// Running reports whether the container launched and hasn't been evicted
+func (l *Lifecycle) Running() bool {
+	return l.running.Load()
+}
+
+// LastRequest is when the container last started or finished serving a
+// request
+func (l *Lifecycle) LastRequest() time.Time {
+	return time.Unix(0, l.lastRequest.Load())
+}
+
+// acquire marks the start of a request so the container isn't reaped while
+// it is being served. It fails once the container is stopping.
+func (l *Lifecycle) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.inflight++
+	l.touch()
+	return true
+}
+
+func (l *Lifecycle) Release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.touch()
+	l.inflight--
+}
+
+func (l *Lifecycle) touch() {
+	l.lastRequest.Store(time.Now().UnixNano())
+}
+
+// markStopping keeps new requests from acquiring the container. It reports
+// false if the container was already stopping.
+func (l *Lifecycle) markStopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.stopping = true
+	return true
+}
+
+// markStoppingIfIdle is markStopping for the reaper. It only marks a
+// container that is idle, deciding both under the same lock acquire takes.
+func (l *Lifecycle) markStoppingIfIdle(defaultIdleTtl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping || !l.running.Load() || l.inflight > 0 {
+		return false
+	}
+	idleTtl := l.deployment.IdleTtl()
+	if idleTtl <= 0 {
+		idleTtl = defaultIdleTtl
+	}
+	if time.Since(l.LastRequest()) <= idleTtl {
+		return false
+	}
+	l.stopping = true
+	return true
+}
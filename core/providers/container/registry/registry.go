@@ -0,0 +1,298 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
+	"pocker/core/syncx"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("container service is shutting down")
+
+// Container is what a provider keeps in a Registry. Providers satisfy it by
+// embedding *Lifecycle.
+type Container interface {
+	ioc.IContainer
+	lifecycle() *Lifecycle
+}
+
+// Registry keeps one container per instance for a container provider. It
+// decides when containers launch, get reaped for being idle and are stopped,
+// and leaves how to the provider.
+type Registry[T Container] struct {
+	initOnce     sync.Once
+	containers   syncx.Map[string, T]
+	count        atomic.Int32
+	started      atomic.Bool
+	shuttingDown atomic.Bool
+	stopOnce     sync.Once
+	stopped      chan struct{}
+	config       RegistryConfig[T]
+}
+
+type RegistryConfig[T Container] struct {
+	// New makes an unlaunched container for a deployment
+	New func(deployment ioc.IDeployment) T
+	// Launch starts a container. It is called once per container, before
+	// any request is handed the container.
+	Launch func(container T) error
+	// Stop shuts a running container down
+	Stop func(container T) error
+	// Cleanup frees what a container holds once it has been evicted,
+	// whether or not it launched
+	Cleanup func(container T)
+	// DefaultIdleTtl applies to instances that don't set their own idleTtl
+	DefaultIdleTtl time.Duration
+	ReapInterval   time.Duration
+}
+
+func New[T Container](config RegistryConfig[T]) *Registry[T] {
+	if config.New == nil || config.Launch == nil || config.Stop == nil {
+		panic("container registry needs New, Launch and Stop")
+	}
+	if config.DefaultIdleTtl == 0 {
+		config.DefaultIdleTtl = 5 * time.Minute
+	}
+	if config.ReapInterval == 0 {
+		config.ReapInterval = 30 * time.Second
+	}
+
+	return &Registry[T]{
+		containers: syncx.Map[string, T]{},
+		stopped:    make(chan struct{}),
+		config:     config,
+	}
+}
+
+// GetOrCreate returns the instance's container, launching it if needed. The
+// container is acquired for a request and the caller must Release it.
+func (r *Registry[T]) GetOrCreate(deployment ioc.IDeployment) (T, error) {
+	var container T
+	if r.shuttingDown.Load() {
+		return container, ErrShuttingDown
+	}
+
+	slog.Debug("Currently cached instances",
+		"count", r.count.Load())
+
+	for {
+		// Only make a container when there isn't one, since most requests
+		// find theirs running
+		loaded, ok := r.containers.Load(deployment.InstanceId())
+		if !ok {
+			loaded, _ = r.containers.LoadOrStore(deployment.InstanceId(), r.config.New(deployment))
+		}
+		container = loaded
+		if container.lifecycle().acquire() {
+			break
+		}
+		// The container is being stopped. Only the stopping side removes it
+		// from the registry, so wait for that and store a fresh one.
+		<-container.lifecycle().evicted
+	}
+
+	l := container.lifecycle()
+	l.initOnce.Do(func() {
+		l.err = r.launch(container)
+		if l.err == nil {
+			l.mu.Lock()
+			if l.gone {
+				// It was evicted for exiting on its own while still launching
+				l.err = fmt.Errorf("container %s exited while starting", deployment.InstanceId())
+			} else {
+				l.running.Store(true)
+				r.count.Add(1)
+			}
+			l.mu.Unlock()
+		}
+		if l.err != nil {
+			l.markStopping()
+			r.evict(container)
+		}
+	})
+
+	if l.err != nil {
+		l.Release()
+		var zero T
+		return zero, l.err
+	}
+	return container, nil
+}
+
+// launch runs the provider's Launch, turning a panic into an error
+func (r *Registry[T]) launch(container T) (err error) {
+	instanceId := container.Deployment().InstanceId()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("failed to initialize container %s: %v", instanceId, recovered)
+		}
+	}()
+	if err := r.config.Launch(container); err != nil {
+		return fmt.Errorf("failed to initialize container %s: %w", instanceId, err)
+	}
+	return nil
+}
+
+// Get returns the instance's container if it is running
+func (r *Registry[T]) Get(instanceId string) (T, bool) {
+	container, ok := r.containers.Load(instanceId)
+	if !ok || !container.lifecycle().Running() {
+		var zero T
+		return zero, false
+	}
+	return container, true
+}
+
+func (r *Registry[T]) Ids() []string {
+	return r.containers.Keys()
+}
+
+// Stop stops an instance's container right away, even if it is serving
+// requests. The next request launches a fresh one.
+func (r *Registry[T]) Stop(instanceId string) bool {
+	container, ok := r.containers.Load(instanceId)
+	if !ok || !container.lifecycle().markStopping() {
+		return false
+	}
+	r.stop(container)
+	return true
+}
+
+// Evict forgets a container that has already gone away on its own. It does
+// nothing if the container is being stopped.
+func (r *Registry[T]) Evict(container T) {
+	if container.lifecycle().markStopping() {
+		r.evict(container)
+	}
+}
+
+// Start registers the running containers gauge and starts the reaper
+func (r *Registry[T]) Start() {
+	r.initOnce.Do(func() {
+		metrics.NewGaugeFunc("pocker_containers_running",
+			"PocketBase containers currently running.",
+			func() float64 {
+				return float64(r.count.Load())
+			})
+		go r.reapIdleContainers()
+		r.started.Store(true)
+	})
+}
+
+func (r *Registry[T]) ReadinessCheck() ioc.ReadinessCheck {
+	return ioc.ReadinessCheck{
+		Name:     "container_service",
+		Required: true,
+		Check: func(ctx context.Context) error {
+			if !r.started.Load() {
+				return errors.New("container service has not started")
+			}
+			if r.shuttingDown.Load() {
+				return ErrShuttingDown
+			}
+			return nil
+		},
+	}
+}
+
+// evict removes a container and frees what it holds. The caller must already
+// have marked it as stopping. It is safe to call more than once.
+func (r *Registry[T]) evict(container T) {
+	l := container.lifecycle()
+	l.evictOnce.Do(func() {
+		r.containers.CompareAndDelete(container.Deployment().InstanceId(), container)
+		l.mu.Lock()
+		l.gone = true
+		if l.running.Swap(false) {
+			r.count.Add(-1)
+		}
+		l.mu.Unlock()
+		if r.config.Cleanup != nil {
+			r.config.Cleanup(container)
+		}
+		close(l.evicted)
+	})
+}
+
+// reapIdleContainers periodically stops containers that have not served a
+// request for longer than their idle TTL, until Shutdown
+func (r *Registry[T]) reapIdleContainers() {
+	ticker := time.NewTicker(r.config.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stopped:
+			return
+		}
+		r.containers.Range(func(instanceId string, container T) bool {
+			if container.lifecycle().markStoppingIfIdle(r.config.DefaultIdleTtl) {
+				slog.Info("Stopping idle container",
+					"instance_id", instanceId,
+					"idle", time.Since(container.lifecycle().LastRequest()))
+				r.stop(container)
+			}
+			return true
+		})
+	}
+}
+
+// stop shuts a container down and evicts it. The caller must already have
+// marked it as stopping.
+func (r *Registry[T]) stop(container T) {
+	l := container.lifecycle()
+	// Wait out an in-progress launch so the container isn't left running
+	l.initOnce.Do(func() {})
+
+	if l.Running() {
+		if err := r.config.Stop(container); err != nil {
+			slog.Warn("Failed to stop container",
+				"instance_id", container.Deployment().InstanceId(),
+				"error", err)
+		}
+	}
+	r.evict(container)
+}
+
+// Shutdown stops accepting launches and stops every running container,
+// giving up when ctx expires
+func (r *Registry[T]) Shutdown(ctx context.Context) error {
+	r.shuttingDown.Store(true)
+	r.stopOnce.Do(func() {
+		close(r.stopped)
+	})
+
+	wg := sync.WaitGroup{}
+	r.containers.Range(func(instanceId string, container T) bool {
+		if !container.lifecycle().markStopping() {
+			return true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.stop(container)
+		}()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All containers stopped")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("containers still running: %w", ctx.Err())
+	}
+}
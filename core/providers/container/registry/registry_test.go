@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"pocker/core/ioc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeDeployment struct {
+	ioc.IDeployment
+	id string
+}
+
+func (d fakeDeployment) InstanceId() string     { return d.id }
+func (d fakeDeployment) IdleTtl() time.Duration { return 0 }
+
+type fakeContainer struct {
+	*Lifecycle
+	stopped chan struct{}
+}
+
+func (c *fakeContainer) Url() *url.URL { return nil }
+
+func (c *fakeContainer) Status() ioc.ContainerStatus {
+	return ioc.ContainerStatus{Running: c.Running()}
+}
+
+type fakeProvider struct {
+	news      atomic.Int32
+	launches  atomic.Int32
+	cleanups  atomic.Int32
+	launchErr error
+	// stopping blocks Stop until it is closed
+	stopping chan struct{}
+}
+
+func newTestRegistry(provider *fakeProvider) *Registry[*fakeContainer] {
+	return New(RegistryConfig[*fakeContainer]{
+		New: func(deployment ioc.IDeployment) *fakeContainer {
+			provider.news.Add(1)
+			return &fakeContainer{Lifecycle: NewLifecycle(deployment), stopped: make(chan struct{})}
+		},
+		Launch: func(container *fakeContainer) error {
+			provider.launches.Add(1)
+			return provider.launchErr
+		},
+		Stop: func(container *fakeContainer) error {
+			if provider.stopping != nil {
+				<-provider.stopping
+			}
+			close(container.stopped)
+			return nil
+		},
+		Cleanup: func(container *fakeContainer) {
+			provider.cleanups.Add(1)
+		},
+		DefaultIdleTtl: -time.Second,
+		ReapInterval:   time.Hour,
+	})
+}
+
+func isStopping(l *Lifecycle) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+func TestAcquiredContainerIsNotReaped(t *testing.T) {
+	r := newTestRegistry(&fakeProvider{})
+
+	container, err := r.GetOrCreate(fakeDeployment{id: "busy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.markStoppingIfIdle(r.config.DefaultIdleTtl) {
+		t.Fatal("markStoppingIfIdle() = true with a request in flight")
+	}
+
+	container.Release()
+	if !container.markStoppingIfIdle(r.config.DefaultIdleTtl) {
+		t.Fatal("markStoppingIfIdle() = false on an idle container")
+	}
+	if container.acquire() {
+		t.Error("acquire() = true on a stopping container")
+	}
+}
+
+func TestRequestWaitsForStoppingContainer(t *testing.T) {
+	provider := &fakeProvider{stopping: make(chan struct{})}
+	r := newTestRegistry(provider)
+
+	first, err := r.GetOrCreate(fakeDeployment{id: "restart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Release()
+
+	stopped := make(chan bool)
+	go func() { stopped <- r.Stop("restart") }()
+
+	// A request arriving mid-stop must not get the stopping container, nor
+	// drop it from the registry while it is still running
+	got := make(chan *fakeContainer)
+	go func() {
+		for !isStopping(first.Lifecycle) {
+			time.Sleep(time.Millisecond)
+		}
+		second, err := r.GetOrCreate(fakeDeployment{id: "restart"})
+		if err != nil {
+			t.Error(err)
+		}
+		got <- second
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if current, ok := r.containers.Load("restart"); !ok || current != first {
+		t.Fatal("stopping container left the registry before it stopped")
+	}
+	close(provider.stopping)
+
+	if !<-stopped {
+		t.Error("Stop() = false, want true")
+	}
+	second := <-got
+	defer second.Release()
+	if second == first {
+		t.Fatal("GetOrCreate() returned the stopped container")
+	}
+	if n := r.count.Load(); n != 1 {
+		t.Errorf("count = %d, want 1", n)
+	}
+	if n := provider.cleanups.Load(); n != 1 {
+		t.Errorf("cleanups = %d, want 1", n)
+	}
+}
+
+func TestFailedLaunchIsEvicted(t *testing.T) {
+	provider := &fakeProvider{launchErr: errors.New("no port")}
+	r := newTestRegistry(provider)
+
+	_, err := r.GetOrCreate(fakeDeployment{id: "broken"})
+	if !errors.Is(err, provider.launchErr) {
+		t.Fatalf("GetOrCreate() error = %v, want %v", err, provider.launchErr)
+	}
+	if ids := r.Ids(); len(ids) != 0 {
+		t.Errorf("Ids() = %v, want none", ids)
+	}
+	if n := provider.cleanups.Load(); n != 1 {
+		t.Errorf("cleanups = %d, want 1", n)
+	}
+
+	provider.launchErr = nil
+	container, err := r.GetOrCreate(fakeDeployment{id: "broken"})
+	if err != nil {
+		t.Fatalf("GetOrCreate() after a failed launch: %v", err)
+	}
+	container.Release()
+}
+
+func TestShutdownStopsContainers(t *testing.T) {
+	r := newTestRegistry(&fakeProvider{})
+
+	container, err := r.GetOrCreate(fakeDeployment{id: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Release()
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-container.stopped:
+	default:
+		t.Error("container not stopped by Shutdown()")
+	}
+	if _, err := r.GetOrCreate(fakeDeployment{id: "late"}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("GetOrCreate() error = %v, want ErrShuttingDown", err)
+	}
+}
+
+func TestRunningContainerIsReused(t *testing.T) {
+	provider := &fakeProvider{}
+	r := newTestRegistry(provider)
+
+	for range 3 {
+		container, err := r.GetOrCreate(fakeDeployment{id: "warm"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		container.Release()
+	}
+	if got := provider.news.Load(); got != 1 {
+		t.Errorf("New called %d times, want 1", got)
+	}
+}
+
+func TestShutdownStopsReaper(t *testing.T) {
+	r := newTestRegistry(&fakeProvider{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.reapIdleContainers()
+	}()
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper kept running after Shutdown()")
+	}
+}
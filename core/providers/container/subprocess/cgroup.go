@@ -0,0 +1,96 @@
+package subprocess
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResourceLimits caps what a container's processes may use. Zero means no
+// limit.
+type ResourceLimits struct {
+	// MemoryMax is in bytes
+	MemoryMax int64
+	// Cpus is how many CPUs' worth of time the container may use, e.g. 0.5
+	Cpus float64
+}
+
+type CgroupConfig struct {
+	// Root is the cgroup v2 directory each container gets its own cgroup
+	// in, e.g. /sys/fs/cgroup/pocker. Empty runs containers without limits,
+	// as does a Root that isn't a writable cgroup v2 directory.
+	Root string
+	// Tiers maps a subscription tier to the limits its instances run under
+	Tiers map[string]ResourceLimits
+	// Default applies to tiers that aren't listed
+	Default ResourceLimits
+}
+
+func (config CgroupConfig) limitsFor(tier string) ResourceLimits {
+	if limits, ok := config.Tiers[tier]; ok {
+		return limits
+	}
+	return config.Default
+}
+
+// ParseResourceLimits parses "<memory>/<cpus>", e.g. "512M/0.5". Memory is in
+// bytes, or in binary units with a K, M or G suffix. Either side may be empty
+// or 0 for no limit.
+func ParseResourceLimits(value string) (ResourceLimits, error) {
+	memory, cpus, _ := strings.Cut(strings.TrimSpace(value), "/")
+
+	limits := ResourceLimits{}
+	if memory != "" {
+		memoryMax, err := parseBytes(memory)
+		if err != nil {
+			return ResourceLimits{}, fmt.Errorf("invalid memory limit %q: %w", memory, err)
+		}
+		limits.MemoryMax = memoryMax
+	}
+	if cpus != "" {
+		cpuLimit, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || cpuLimit < 0 {
+			return ResourceLimits{}, fmt.Errorf("invalid cpu limit %q", cpus)
+		}
+		limits.Cpus = cpuLimit
+	}
+	return limits, nil
+}
+
+// ParseResourceLimitTiers parses a tier to "<memory>/<cpus>" map, as read
+// from the environment
+func ParseResourceLimitTiers(tiers map[string]string) (map[string]ResourceLimits, error) {
+	parsed := make(map[string]ResourceLimits, len(tiers))
+	for tier, value := range tiers {
+		limits, err := ParseResourceLimits(value)
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %w", tier, err)
+		}
+		parsed[tier] = limits
+	}
+	return parsed, nil
+}
+
+func parseBytes(value string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size")
+	}
+	return n * multiplier, nil
+}
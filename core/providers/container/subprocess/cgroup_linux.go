@@ -0,0 +1,227 @@
+package subprocess
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cgroup2SuperMagic is the filesystem type statfs reports for cgroup v2
+const cgroup2SuperMagic = 0x63677270
+
+// cpuPeriod is the cpu.max period, in microseconds, quotas are given over
+const cpuPeriod = 100000
+
+// isCgroup2 reports whether path is on a cgroup v2 filesystem. Tests swap it
+// out to run against a plain directory.
+var isCgroup2 = func(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	return stat.Type == cgroup2SuperMagic
+}
+
+// cgroupManager creates a cgroup for each container under a root it has
+// delegated the memory and cpu controllers to
+type cgroupManager struct {
+	root string
+	// next numbers cgroups, so a container replacing one that is still
+	// being removed never shares its cgroup
+	next atomic.Int64
+}
+
+// cgroup is one container's cgroup. Every process the container runs is
+// placed in it, across restarts.
+type cgroup struct {
+	dir    string
+	limits ResourceLimits
+}
+
+func newCgroupManager(root string) (*cgroupManager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	if !isCgroup2(root) {
+		return nil, fmt.Errorf("%s is not on a cgroup v2 filesystem", root)
+	}
+	// Controllers have to be enabled all the way down for the containers'
+	// cgroups to get them
+	for _, dir := range []string{filepath.Dir(root), root} {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &cgroupManager{root: root}
+	m.removeLeftovers()
+	return m, nil
+}
+
+func enableControllers(dir string) error {
+	path := filepath.Join(dir, "cgroup.subtree_control")
+	enabled, err := os.ReadFile(path)
+	if err == nil {
+		fields := strings.Fields(string(enabled))
+		if containsAll(fields, "memory", "cpu") {
+			return nil
+		}
+	}
+	if err := os.WriteFile(path, []byte("+memory +cpu"), 0644); err != nil {
+		return fmt.Errorf("failed to enable the memory and cpu controllers in %s: %w", dir, err)
+	}
+	return nil
+}
+
+func containsAll(fields []string, want ...string) bool {
+	for _, w := range want {
+		found := false
+		for _, field := range fields {
+			if field == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// removeLeftovers removes cgroups a previous run didn't get to, killing
+// anything still in them
+func (m *cgroupManager) removeLeftovers() {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		cg := &cgroup{dir: filepath.Join(m.root, entry.Name())}
+		if err := cg.remove(); err != nil {
+			slog.Warn("Failed to remove leftover cgroup",
+				"path", cg.dir,
+				"error", err)
+		}
+	}
+}
+
+func (m *cgroupManager) create(name string, limits ResourceLimits) (*cgroup, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid cgroup name %q", name)
+	}
+
+	cg := &cgroup{
+		dir:    filepath.Join(m.root, fmt.Sprintf("%s-%d", name, m.next.Add(1))),
+		limits: limits,
+	}
+	if err := os.Mkdir(cg.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := cg.applyLimits(); err != nil {
+		cg.remove()
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) applyLimits() error {
+	memoryMax := "max"
+	if cg.limits.MemoryMax > 0 {
+		memoryMax = strconv.FormatInt(cg.limits.MemoryMax, 10)
+		// Without this a limited container swaps instead of being killed.
+		// The file is missing when swap accounting is off.
+		_ = cg.write("memory.swap.max", "0")
+	}
+	if err := cg.write("memory.max", memoryMax); err != nil {
+		return err
+	}
+	// Kill the whole container on OOM rather than leaving it half running
+	if err := cg.write("memory.oom.group", "1"); err != nil {
+		return err
+	}
+
+	cpuMax := fmt.Sprintf("max %d", cpuPeriod)
+	if cg.limits.Cpus > 0 {
+		quota := max(int64(cg.limits.Cpus*cpuPeriod), 1000)
+		cpuMax = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+	return cg.write("cpu.max", cpuMax)
+}
+
+func (cg *cgroup) write(file string, value string) error {
+	return os.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0644)
+}
+
+// startIn starts cmd inside the cgroup, so the child is limited from its
+// first instruction and nothing it forks can land outside. It needs clone3
+// and a real cgroup, so it fails on kernels older than 5.7.
+func (cg *cgroup) startIn(cmd *exec.Cmd) error {
+	dir, err := os.Open(cg.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return cmd.Start()
+}
+
+// add moves a process into the cgroup. Children it starts afterwards stay in
+// it.
+func (cg *cgroup) add(pid int) error {
+	return cg.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// oomKills is how many processes the OOM killer has killed in the cgroup
+// since it was created
+func (cg *cgroup) oomKills() int {
+	events, err := os.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(events))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		if key == "oom_kill" {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
+
+// remove kills whatever is left in the cgroup and deletes it. The kernel
+// only lets go of an empty cgroup once its processes are reaped, so this
+// retries for a little while.
+func (cg *cgroup) remove() error {
+	_ = cg.write("cgroup.kill", "1")
+
+	var err error
+	for range 10 {
+		err = syscall.Rmdir(cg.dir)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return err
+}
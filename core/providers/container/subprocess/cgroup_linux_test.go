@@ -0,0 +1,141 @@
+package subprocess
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCgroupRoot makes a plain directory pass for a cgroup v2 one, so the
+// files the provider writes can be checked without root or a cgroup mount
+func fakeCgroupRoot(t *testing.T) string {
+	t.Helper()
+	saved := isCgroup2
+	isCgroup2 = func(path string) bool { return true }
+	t.Cleanup(func() { isCgroup2 = saved })
+	return filepath.Join(t.TempDir(), "pocker")
+}
+
+func readCgroupFile(t *testing.T, dir string, file string) string {
+	t.Helper()
+	contents, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestCgroupManagerAppliesLimits(t *testing.T) {
+	root := fakeCgroupRoot(t)
+	m, err := newCgroupManager(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{filepath.Dir(root), root} {
+		if got := readCgroupFile(t, dir, "cgroup.subtree_control"); got != "+memory +cpu" {
+			t.Errorf("%s subtree_control = %q", dir, got)
+		}
+	}
+
+	limited, err := m.create("limited", ResourceLimits{MemoryMax: 256 << 20, Cpus: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"memory.max":       "268435456",
+		"memory.swap.max":  "0",
+		"memory.oom.group": "1",
+		"cpu.max":          "50000 100000",
+	}
+	for file, value := range want {
+		if got := readCgroupFile(t, limited.dir, file); got != value {
+			t.Errorf("%s = %q, want %q", file, got, value)
+		}
+	}
+
+	unlimited, err := m.create("unlimited", ResourceLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readCgroupFile(t, unlimited.dir, "memory.max"); got != "max" {
+		t.Errorf("memory.max = %q, want max", got)
+	}
+	if got := readCgroupFile(t, unlimited.dir, "cpu.max"); got != "max 100000" {
+		t.Errorf("cpu.max = %q, want max 100000", got)
+	}
+
+	if _, err := m.create("../escape", ResourceLimits{}); err == nil {
+		t.Error("create() accepted a name outside the root")
+	}
+}
+
+func TestCgroupUnavailableRunsWithoutLimits(t *testing.T) {
+	sm := newTestServiceWith(t, ContainerProviderConfig{
+		BinaryPath: testBinary(t),
+		Cgroups: CgroupConfig{
+			Root:    t.TempDir(),
+			Default: ResourceLimits{MemoryMax: 256 << 20},
+		},
+	})
+	sm.Start()
+	if sm.cgroups != nil {
+		t.Fatal("cgroups enabled on a directory that isn't a cgroup")
+	}
+
+	container, err := sm.GetOrCreateContainer(newDeployment("unlimited", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Release()
+	if got := container.Status(); got.MemoryMax != 0 || got.Cpus != 0 {
+		t.Errorf("Status() = %+v, want no limits", got)
+	}
+}
+
+func TestContainerReportsOomKills(t *testing.T) {
+	sm := newTestServiceWith(t, ContainerProviderConfig{
+		BinaryPath: testBinary(t),
+		Cgroups: CgroupConfig{
+			Root:    fakeCgroupRoot(t),
+			Default: ResourceLimits{MemoryMax: 128 << 20, Cpus: 1},
+		},
+	})
+	sm.Start()
+
+	c, err := sm.GetOrCreateContainer(newDeployment("oom", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Release()
+	container := c.(*Container)
+
+	if got := container.Status(); got.MemoryMax != 128<<20 || got.Cpus != 1 {
+		t.Errorf("Status() = %+v, want 128M/1", got)
+	}
+	pid, err := get(t, container, "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(readCgroupFile(t, container.cgroup.dir, "cgroup.procs")); got != pid {
+		t.Errorf("cgroup.procs = %s, want %s", got, pid)
+	}
+
+	// Stand in for the kernel killing the process at its memory limit
+	events := "oom 1\noom_kill 1\n"
+	if err := os.WriteFile(filepath.Join(container.cgroup.dir, "memory.events"), []byte(events), 0644); err != nil {
+		t.Fatal(err)
+	}
+	get(t, container, "/crash")
+
+	eventually(t, "the restart after the OOM kill", func() bool {
+		return container.Status().Restarts == 1
+	})
+	if got := container.Status().OomKills; got != 1 {
+		t.Errorf("Status().OomKills = %d, want 1", got)
+	}
+	eventually(t, "the restarted process", func() bool {
+		newPid, err := get(t, container, "/pid")
+		return err == nil && newPid != pid && strings.TrimSpace(readCgroupFile(t, container.cgroup.dir, "cgroup.procs")) == newPid
+	})
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package subprocess
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errCgroupsUnsupported = errors.New("cgroups are only available on Linux")
+
+type cgroupManager struct{}
+
+type cgroup struct {
+	limits ResourceLimits
+}
+
+func newCgroupManager(root string) (*cgroupManager, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (m *cgroupManager) create(name string, limits ResourceLimits) (*cgroup, error) {
+	return nil, errCgroupsUnsupported
+}
+
+func (cg *cgroup) startIn(cmd *exec.Cmd) error {
+	return errCgroupsUnsupported
+}
+
+func (cg *cgroup) add(pid int) error {
+	return errCgroupsUnsupported
+}
+
+func (cg *cgroup) oomKills() int {
+	return 0
+}
+
+func (cg *cgroup) remove() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package subprocess
+
+import "testing"
+
+func TestParseResourceLimits(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ResourceLimits
+	}{
+		{"512M/0.5", ResourceLimits{MemoryMax: 512 << 20, Cpus: 0.5}},
+		{"1G/2", ResourceLimits{MemoryMax: 1 << 30, Cpus: 2}},
+		{"268435456", ResourceLimits{MemoryMax: 256 << 20}},
+		{"/1.5", ResourceLimits{Cpus: 1.5}},
+		{"0/0", ResourceLimits{}},
+		{"", ResourceLimits{}},
+	}
+	for _, tt := range tests {
+		got, err := ParseResourceLimits(tt.value)
+		if err != nil {
+			t.Errorf("ParseResourceLimits(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseResourceLimits(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"lots/1", "512M/fast", "-1M/1", "512M/-1", "M/1"} {
+		if _, err := ParseResourceLimits(value); err == nil {
+			t.Errorf("ParseResourceLimits(%q) succeeded, want error", value)
+		}
+	}
+}
+
+func TestLimitsForTier(t *testing.T) {
+	tiers, err := ParseResourceLimitTiers(map[string]string{"premium": "2G/2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := CgroupConfig{Tiers: tiers, Default: ResourceLimits{MemoryMax: 256 << 20, Cpus: 0.25}}
+
+	if got := config.limitsFor("premium"); got != (ResourceLimits{MemoryMax: 2 << 30, Cpus: 2}) {
+		t.Errorf("limitsFor(premium) = %+v", got)
+	}
+	if got := config.limitsFor("free"); got != config.Default {
+		t.Errorf("limitsFor(free) = %+v, want the default", got)
+	}
+}
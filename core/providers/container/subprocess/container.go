@@ -0,0 +1,297 @@
+package subprocess
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
+	"pocker/core/providers/container/registry"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ ioc.IContainer = (*Container)(nil)
+
+var errStopped = errors.New("container was stopped")
+
+var oomKillsTotal = metrics.NewCounterVec("pocker_container_oom_kills_total",
+	"PocketBase processes killed for going over their cgroup memory limit, by subscription tier.",
+	"tier")
+
+// healthPollInterval is how often a starting process's health endpoint is
+// polled
+const healthPollInterval = 100 * time.Millisecond
+
+type Container struct {
+	*registry.Lifecycle
+	port   int
+	url    *url.URL
+	dir    string
+	binary string
+	output *outputTail
+	// cgroup holds the container's processes. It is nil when the container
+	// runs without resource limits.
+	cgroup *cgroup
+
+	mu      sync.Mutex
+	process *process
+	// stopped is closed when the container is told to stop, so the
+	// supervisor stops restarting it
+	stopped        chan struct{}
+	stopOnce       sync.Once
+	supervisorDone chan struct{}
+
+	restarts atomic.Int32
+	oomKills atomic.Int32
+}
+
+// process is one run of the PocketBase binary. A container goes through a
+// new one every time the supervisor restarts it.
+type process struct {
+	cmd       *exec.Cmd
+	startedAt time.Time
+	exited    chan struct{}
+	// err is how the process exited, and oomKilled whether the cgroup's OOM
+	// killer did it. Only read them after exited is closed.
+	err       error
+	oomKilled bool
+}
+
+func newContainer(deployment ioc.IDeployment) *Container {
+	return &Container{
+		Lifecycle:      registry.NewLifecycle(deployment),
+		output:         &outputTail{},
+		stopped:        make(chan struct{}),
+		supervisorDone: make(chan struct{}),
+	}
+}
+
+func (c *Container) Url() *url.URL {
+	return c.url
+}
+
+// Status reports the cgroup's limits, which are zero when the container runs
+// without one
+func (c *Container) Status() ioc.ContainerStatus {
+	status := ioc.ContainerStatus{
+		Running:  c.Running(),
+		Restarts: int(c.restarts.Load()),
+		OomKills: int(c.oomKills.Load()),
+	}
+	if c.cgroup != nil {
+		status.MemoryMax = c.cgroup.limits.MemoryMax
+		status.Cpus = c.cgroup.limits.Cpus
+	}
+	return status
+}
+
+func (c *Container) currentProcess() *process {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.process
+}
+
+// launch starts the PocketBase binary and waits for it to answer its health
+// check. A process that doesn't come up is killed before returning.
+func (c *Container) launch(config ContainerProviderConfig) error {
+	instanceId := c.Deployment().InstanceId()
+	stdout := newLineWriter(instanceId, "stdout", c.output)
+	stderr := newLineWriter(instanceId, "stderr", c.output)
+
+	cmd, err := c.start(config, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("failed to run %s: %w", c.binary, err)
+	}
+
+	p := &process{
+		cmd:       cmd,
+		startedAt: time.Now(),
+		exited:    make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+		p.oomKilled = c.checkOom()
+		close(p.exited)
+	}()
+
+	c.mu.Lock()
+	c.process = p
+	c.mu.Unlock()
+
+	if err := c.waitHealthy(p, config.StartTimeout); err != nil {
+		c.terminate(p, config.StopTimeout)
+		return err
+	}
+	return nil
+}
+
+// start runs the binary inside the container's cgroup. Where the kernel
+// can't start it there, it is moved in right after starting, which leaves
+// a moment in which it runs without limits.
+func (c *Container) start(config ContainerProviderConfig, stdout io.Writer, stderr io.Writer) (*exec.Cmd, error) {
+	instanceId := c.Deployment().InstanceId()
+
+	if c.cgroup != nil {
+		cmd := c.command(config, stdout, stderr)
+		err := c.cgroup.startIn(cmd)
+		if err == nil {
+			return cmd, nil
+		}
+		slog.Debug("Failed to start PocketBase inside its cgroup, moving it in after it starts",
+			"instance_id", instanceId,
+			"error", err)
+	}
+
+	// A Cmd can't be started twice, even after failing to start
+	cmd := c.command(config, stdout, stderr)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if c.cgroup != nil {
+		if err := c.cgroup.add(cmd.Process.Pid); err != nil {
+			slog.Warn("Failed to move PocketBase into its cgroup, running without limits",
+				"instance_id", instanceId,
+				"error", err)
+		}
+	}
+	return cmd, nil
+}
+
+func (c *Container) command(config ContainerProviderConfig, stdout io.Writer, stderr io.Writer) *exec.Cmd {
+	cmd := exec.Command(c.binary, c.args(config)...)
+	cmd.Dir = c.dir
+	cmd.Env = instanceEnv(c.Deployment().Secrets())
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Don't let a grandchild holding the output pipes keep Wait from
+	// returning
+	cmd.WaitDelay = config.StopTimeout
+	configureProcess(cmd)
+	return cmd
+}
+
+func (c *Container) args(config ContainerProviderConfig) []string {
+	args := []string{
+		"serve",
+		"--http=" + c.url.Host,
+		"--dir=" + filepath.Join(c.dir, "pb_data"),
+		"--hooksDir=" + filepath.Join(c.dir, "pb_hooks"),
+		"--migrationsDir=" + filepath.Join(c.dir, "pb_migrations"),
+		"--publicDir=" + filepath.Join(c.dir, "pb_public"),
+	}
+	if config.DevMode {
+		args = append(args, "--dev")
+	}
+	return args
+}
+
+// instanceEnv is the child's whole environment. It holds the instance's
+// secrets and nothing from the Pocker process.
+func instanceEnv(secrets map[string]string) []string {
+	env := make([]string, 0, len(secrets))
+	for key, value := range secrets {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			continue
+		}
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+func (c *Container) waitHealthy(p *process, timeout time.Duration) error {
+	client := http.Client{Timeout: time.Second}
+	healthUrl := c.url.JoinPath("/api/health").String()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.exited:
+			if p.oomKilled {
+				return fmt.Errorf("ran out of memory before becoming healthy (limit %d bytes)", c.cgroup.limits.MemoryMax)
+			}
+			return fmt.Errorf("exited before becoming healthy (%v): %s", p.err, c.output.String())
+		case <-c.stopped:
+			return errStopped
+		case <-deadline.C:
+			return fmt.Errorf("not healthy after %s", timeout)
+		case <-ticker.C:
+			resp, err := client.Get(healthUrl)
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+	}
+}
+
+// checkOom reports whether the cgroup's OOM killer has fired since it was
+// last checked. It is only called as a process exits, and processes don't
+// overlap, so the count needs no locking.
+func (c *Container) checkOom() bool {
+	if c.cgroup == nil {
+		return false
+	}
+	kills := int32(c.cgroup.oomKills())
+	if kills <= c.oomKills.Load() {
+		return false
+	}
+	c.oomKills.Store(kills)
+	oomKillsTotal.Inc(c.Deployment().Subscription())
+	slog.Warn("PocketBase ran out of memory",
+		"instance_id", c.Deployment().InstanceId(),
+		"memory_max", c.cgroup.limits.MemoryMax)
+	return true
+}
+
+// stop keeps the supervisor from restarting the process, then terminates it
+func (c *Container) stop(timeout time.Duration) error {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+	<-c.supervisorDone
+	return c.terminate(c.currentProcess(), timeout)
+}
+
+// terminate asks a process to exit and kills it if it hasn't within timeout
+func (c *Container) terminate(p *process, timeout time.Duration) error {
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+
+	if err := signalTerminate(p.cmd); err != nil {
+		killProcess(p.cmd)
+		<-p.exited
+		return nil
+	}
+
+	select {
+	case <-p.exited:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	killProcess(p.cmd)
+	<-p.exited
+	return fmt.Errorf("process did not exit within %s and was killed", timeout)
+}
@@ -0,0 +1,89 @@
+package subprocess
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// outputTailLines is how many recent output lines a container keeps for
+// error messages
+const outputTailLines = 20
+
+// maxLineLength caps how much of an unterminated line is buffered before it
+// is logged anyway
+const maxLineLength = 64 * 1024
+
+// outputTail keeps the last few lines a container's processes wrote, so a
+// failed start can say why
+type outputTail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *outputTail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > outputTailLines {
+		t.lines = t.lines[len(t.lines)-outputTailLines:]
+	}
+}
+
+func (t *outputTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// lineWriter logs everything a process writes to one of its streams, a line
+// at a time. exec copies each stream from a single goroutine, so it needs no
+// locking of its own.
+type lineWriter struct {
+	instanceId string
+	stream     string
+	tail       *outputTail
+	buf        []byte
+}
+
+func newLineWriter(instanceId string, stream string, tail *outputTail) *lineWriter {
+	return &lineWriter{
+		instanceId: instanceId,
+		stream:     stream,
+		tail:       tail,
+	}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) >= maxLineLength {
+		w.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs whatever is left of an unterminated line
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+	}
+	w.buf = nil
+}
+
+func (w *lineWriter) emit(line []byte) {
+	text := strings.TrimRight(string(line), "\r")
+	w.tail.add(text)
+	slog.Info("PocketBase output",
+		"instance_id", w.instanceId,
+		"stream", w.stream,
+		"line", text)
+}
@@ -0,0 +1,24 @@
+package subprocess
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// configureProcess puts the child in its own process group, so stopping it
+// also stops anything its hooks spawned, and has the kernel kill it if
+// Pocker dies first
+func configureProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
+
+func signalTerminate(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcess(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package subprocess
+
+import (
+	"os"
+	"os/exec"
+)
+
+func configureProcess(cmd *exec.Cmd) {}
+
+func signalTerminate(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(os.Interrupt)
+}
+
+func killProcess(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
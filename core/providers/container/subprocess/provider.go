@@ -0,0 +1,346 @@
+package subprocess
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
+	"pocker/core/providers/container/registry"
+	"sync"
+	"time"
+)
+
+var _ ioc.IContainerService = (*ContainerService)(nil)
+var _ ioc.IGracefulService = (*ContainerService)(nil)
+var _ ioc.IReadinessService = (*ContainerService)(nil)
+
+var processExitsTotal = metrics.NewCounterVec("pocker_container_process_exits_total",
+	"PocketBase child processes that exited on their own, by what the supervisor did next.",
+	"action")
+
+// ContainerService runs each instance's PocketBase as a child process, so a
+// tenant's crash or runaway hook can't take the proxy down with it
+type ContainerService struct {
+	initOnce   sync.Once
+	containers *registry.Registry[*Container]
+	config     ContainerProviderConfig
+	// cgroups is nil when containers run without resource limits
+	cgroups *cgroupManager
+}
+
+type ContainerProviderConfig struct {
+	DataRoot string
+	// BinaryPath is the PocketBase executable for instances that don't ask
+	// for a version, or for every instance when Binaries is nil
+	BinaryPath string
+	// Binaries finds the executable for the version an instance asks for
+	Binaries BinaryResolver
+	DevMode  bool
+	// DefaultIdleTtl applies to instances that don't set their own idleTtl
+	DefaultIdleTtl time.Duration
+	ReapInterval   time.Duration
+	// StartTimeout is how long a process has to answer its health check.
+	// Defaults to 30s.
+	StartTimeout time.Duration
+	// StopTimeout is how long a process has to exit after SIGTERM before it
+	// is killed. Defaults to 10s.
+	StopTimeout time.Duration
+	// RestartBackoff is the delay before restarting a crashed process. It
+	// doubles on every crash in a row, up to MaxRestartBackoff. Defaults to
+	// 1s and 1m.
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	// MaxRestarts is how many crashes in a row are restarted before the
+	// container is evicted. A process that stays up for MaxRestartBackoff
+	// resets the count. Defaults to 5.
+	MaxRestarts int
+	// Cgroups limits each container's memory and CPU by subscription tier
+	Cgroups CgroupConfig
+}
+
+// BinaryResolver finds the PocketBase executable for a version
+type BinaryResolver interface {
+	Resolve(version string) (string, error)
+}
+
+func New(config ContainerProviderConfig) *ContainerService {
+	if config.BinaryPath == "" && config.Binaries == nil {
+		panic("subprocess container provider needs a PocketBase binary path or a binary cache")
+	}
+	if config.StartTimeout == 0 {
+		config.StartTimeout = 30 * time.Second
+	}
+	if config.StopTimeout == 0 {
+		config.StopTimeout = 10 * time.Second
+	}
+	if config.RestartBackoff == 0 {
+		config.RestartBackoff = time.Second
+	}
+	if config.MaxRestartBackoff == 0 {
+		config.MaxRestartBackoff = time.Minute
+	}
+	if config.MaxRestarts == 0 {
+		config.MaxRestarts = 5
+	}
+
+	provider := ContainerService{
+		config: config,
+	}
+	provider.containers = registry.New(registry.RegistryConfig[*Container]{
+		New:    newContainer,
+		Launch: provider.launch,
+		Stop: func(container *Container) error {
+			return container.stop(config.StopTimeout)
+		},
+		Cleanup:        provider.cleanup,
+		DefaultIdleTtl: config.DefaultIdleTtl,
+		ReapInterval:   config.ReapInterval,
+	})
+
+	return &provider
+}
+
+// ensureDir creates a directory if it doesn't exist
+func ensureDir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (sm *ContainerService) GetOrCreateContainer(deployment ioc.IDeployment) (ioc.IContainer, error) {
+	container, err := sm.containers.GetOrCreate(deployment)
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// launch starts the container's first process and the supervisor that
+// restarts it
+func (sm *ContainerService) launch(container *Container) error {
+	deployment := container.Deployment()
+
+	binary, err := sm.binaryFor(deployment)
+	if err != nil {
+		return err
+	}
+	container.binary = binary
+
+	port, err := ioc.Port().AllocatePort()
+	if err != nil {
+		return fmt.Errorf("failed to allocate port: %w", err)
+	}
+	container.port = port
+	container.url = &url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("127.0.0.1:%d", port),
+	}
+
+	// Ensure subdomain directory exists
+	container.dir = sm.dataDir(deployment.InstanceId())
+	if err := ensureDir(container.dir); err != nil {
+		return fmt.Errorf("failed to create instance directory: %w", err)
+	}
+	container.cgroup = sm.createCgroup(deployment)
+
+	if err := container.launch(sm.config); err != nil {
+		return fmt.Errorf("failed to start server %s: %w", deployment.InstanceId(), err)
+	}
+
+	slog.Debug("Server started",
+		"instance_id", deployment.InstanceId(),
+		"port", port)
+
+	go func() {
+		defer close(container.supervisorDone)
+		sm.supervise(container)
+	}()
+	return nil
+}
+
+// binaryFor picks the executable an instance runs. Without a binary cache
+// every instance runs BinaryPath, whatever version it asks for.
+func (sm *ContainerService) binaryFor(deployment ioc.IDeployment) (string, error) {
+	version := deployment.Version()
+	if sm.config.Binaries == nil || version == "" {
+		if sm.config.BinaryPath == "" {
+			return "", fmt.Errorf("%w: the instance doesn't ask for a version and there is no default binary", ioc.ErrVersionUnavailable)
+		}
+		return sm.config.BinaryPath, nil
+	}
+	return sm.config.Binaries.Resolve(version)
+}
+
+// createCgroup gives a container a cgroup with its tier's limits. Without
+// one the container still runs, just unconstrained.
+func (sm *ContainerService) createCgroup(deployment ioc.IDeployment) *cgroup {
+	if sm.cgroups == nil {
+		return nil
+	}
+	limits := sm.config.Cgroups.limitsFor(deployment.Subscription())
+	cg, err := sm.cgroups.create(deployment.InstanceId(), limits)
+	if err != nil {
+		slog.Warn("Failed to create cgroup, running without limits",
+			"instance_id", deployment.InstanceId(),
+			"error", err)
+		return nil
+	}
+	return cg
+}
+
+func (sm *ContainerService) GetContainer(instanceId string) (ioc.IContainer, bool) {
+	container, ok := sm.containers.Get(instanceId)
+	if !ok {
+		return nil, false
+	}
+	return container, true
+}
+
+func (sm *ContainerService) ContainerIds() []string {
+	return sm.containers.Ids()
+}
+
+// StopContainer stops an instance's container right away, even if it is
+// serving requests. The next request launches a fresh one.
+func (sm *ContainerService) StopContainer(instanceId string) bool {
+	return sm.containers.Stop(instanceId)
+}
+
+// Start leaves the data root alone. It holds instance data that outlives the
+// process.
+func (sm *ContainerService) Start() {
+	sm.initOnce.Do(func() {
+		sm.startCgroups()
+		sm.containers.Start()
+	})
+}
+
+func (sm *ContainerService) startCgroups() {
+	if sm.config.Cgroups.Root == "" {
+		return
+	}
+	cgroups, err := newCgroupManager(sm.config.Cgroups.Root)
+	if err != nil {
+		slog.Warn("Cgroups unavailable, running containers without resource limits",
+			"root", sm.config.Cgroups.Root,
+			"error", err)
+		return
+	}
+	sm.cgroups = cgroups
+}
+
+func (sm *ContainerService) ReadinessChecks() []ioc.ReadinessCheck {
+	checks := []ioc.ReadinessCheck{sm.containers.ReadinessCheck()}
+	if sm.config.BinaryPath != "" {
+		checks = append(checks, ioc.ReadinessCheck{
+			Name:     "pocketbase_binary",
+			Required: true,
+			Check: func(ctx context.Context) error {
+				info, err := os.Stat(sm.config.BinaryPath)
+				if err != nil {
+					return err
+				}
+				if info.IsDir() || info.Mode()&0111 == 0 {
+					return fmt.Errorf("%s is not executable", sm.config.BinaryPath)
+				}
+				return nil
+			},
+		})
+	}
+	return checks
+}
+
+// supervise restarts a container's process when it exits on its own,
+// backing off between attempts. A container that keeps crashing is evicted
+// so the next request starts over with a fresh one.
+func (sm *ContainerService) supervise(container *Container) {
+	backoff := sm.config.RestartBackoff
+	crashes := 0
+	for {
+		process := container.currentProcess()
+		select {
+		case <-process.exited:
+		case <-container.stopped:
+			return
+		}
+		// stop closes stopped before signalling, so an exit it caused is
+		// never mistaken for a crash
+		select {
+		case <-container.stopped:
+			return
+		default:
+		}
+
+		ranFor := time.Since(process.startedAt)
+		if ranFor > sm.config.MaxRestartBackoff {
+			crashes = 0
+			backoff = sm.config.RestartBackoff
+		}
+		crashes++
+
+		if crashes > sm.config.MaxRestarts {
+			processExitsTotal.Inc("evict")
+			slog.Error("PocketBase keeps crashing, giving up",
+				"instance_id", container.Deployment().InstanceId(),
+				"crashes", crashes,
+				"error", process.err,
+				"oom_killed", process.oomKilled,
+				"output", container.output.String())
+			sm.containers.Evict(container)
+			return
+		}
+
+		processExitsTotal.Inc("restart")
+		container.restarts.Add(1)
+		slog.Warn("PocketBase exited, restarting",
+			"instance_id", container.Deployment().InstanceId(),
+			"error", process.err,
+			"oom_killed", process.oomKilled,
+			"ran_for", ranFor,
+			"restart_in", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-container.stopped:
+			return
+		}
+		backoff = min(backoff*2, sm.config.MaxRestartBackoff)
+
+		// A failed launch leaves an exited process behind, which the next
+		// pass counts as another crash
+		if err := container.launch(sm.config); err != nil {
+			slog.Warn("Failed to restart PocketBase",
+				"instance_id", container.Deployment().InstanceId(),
+				"error", err)
+		}
+	}
+}
+
+// cleanup returns an evicted container's port and removes its cgroup
+func (sm *ContainerService) cleanup(container *Container) {
+	if container.port != 0 {
+		ioc.Port().ReleasePort(container.port)
+	}
+	if container.cgroup != nil {
+		if err := container.cgroup.remove(); err != nil {
+			slog.Warn("Failed to remove cgroup",
+				"instance_id", container.Deployment().InstanceId(),
+				"error", err)
+		}
+	}
+}
+
+// Shutdown stops every running container, giving up when ctx expires
+func (sm *ContainerService) Shutdown(ctx context.Context) error {
+	return sm.containers.Shutdown(ctx)
+}
+
+func (sm *ContainerService) dataDir(paths ...string) string {
+	abs, err := filepath.Abs(filepath.Join(sm.config.DataRoot, filepath.Join(paths...)))
+	if err != nil {
+		panic(fmt.Errorf("failed to get absolute path for data root: %w", err))
+	}
+	return abs
+}
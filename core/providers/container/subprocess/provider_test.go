@@ -0,0 +1,308 @@
+package subprocess
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"pocker/core/ioc"
+	"pocker/core/services/port/port_range"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePocketBaseSecret is passed as an instance secret, so it reaches the
+// child through the only environment it gets
+const fakePocketBaseSecret = "POCKER_FAKE_POCKETBASE"
+
+// TestMain turns the test binary into a stand-in PocketBase when it is
+// launched as a container
+func TestMain(m *testing.M) {
+	if os.Getenv(fakePocketBaseSecret) != "" {
+		fakePocketBase(os.Args[1:])
+		return
+	}
+	ioc.RegisterPortService(port_range.New(port_range.FixedPortRangeProviderConfig{
+		PortRangeStart: 23000,
+		PortRangeEnd:   23100,
+	}))
+	os.Exit(m.Run())
+}
+
+// fakePocketBase answers the health check and a few endpoints the tests use
+// to poke at the process. CRASH_ON_START and EXIT_AFTER make it misbehave.
+func fakePocketBase(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	httpAddr := flags.String("http", "", "")
+	flags.String("dir", "", "")
+	flags.String("hooksDir", "", "")
+	flags.String("migrationsDir", "", "")
+	flags.String("publicDir", "", "")
+	flags.Bool("dev", false, "")
+	if len(args) == 0 || args[0] != "serve" {
+		os.Exit(2)
+	}
+	flags.Parse(args[1:])
+
+	if message := os.Getenv("CRASH_ON_START"); message != "" {
+		fmt.Fprintln(os.Stderr, message)
+		os.Exit(1)
+	}
+	if exitAfter, err := time.ParseDuration(os.Getenv("EXIT_AFTER")); err == nil {
+		time.AfterFunc(exitAfter, func() { os.Exit(1) })
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/env", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(os.Environ())
+	})
+	mux.HandleFunc("/pid", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, os.Getpid())
+	})
+	mux.HandleFunc("/crash", func(w http.ResponseWriter, r *http.Request) {
+		os.Exit(3)
+	})
+
+	fmt.Println("fake pocketbase listening on", *httpAddr)
+	if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type fakeDeployment struct {
+	id      string
+	version string
+	secrets map[string]string
+}
+
+func (d fakeDeployment) IsLegacy() bool                  { return false }
+func (d fakeDeployment) InstanceId() string              { return d.id }
+func (d fakeDeployment) Subdomain() string               { return d.id }
+func (d fakeDeployment) MachineId() string               { return "" }
+func (d fakeDeployment) IsUserVerified() bool            { return true }
+func (d fakeDeployment) IsUserSuspended() bool           { return false }
+func (d fakeDeployment) IsInstanceSuspended() bool       { return false }
+func (d fakeDeployment) IsInstancePoweredOn() bool       { return true }
+func (d fakeDeployment) InstanceSuspendedReason() string { return "" }
+func (d fakeDeployment) UserSuspendedReason() string     { return "" }
+func (d fakeDeployment) PrivateUrl() *url.URL            { return nil }
+func (d fakeDeployment) IdleTtl() time.Duration          { return 0 }
+func (d fakeDeployment) Subscription() string            { return "" }
+func (d fakeDeployment) Version() string                 { return d.version }
+func (d fakeDeployment) Secrets() map[string]string      { return d.secrets }
+
+func newDeployment(id string, secrets map[string]string) fakeDeployment {
+	all := map[string]string{fakePocketBaseSecret: "1"}
+	for key, value := range secrets {
+		all[key] = value
+	}
+	return fakeDeployment{id: id, secrets: all}
+}
+
+// fakeBinaries resolves the versions it knows to the test binary
+type fakeBinaries map[string]string
+
+func (b fakeBinaries) Resolve(version string) (string, error) {
+	path, ok := b[version]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ioc.ErrVersionUnavailable, version)
+	}
+	return path, nil
+}
+
+func testBinary(t *testing.T) string {
+	t.Helper()
+	binary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func newTestService(t *testing.T) *ContainerService {
+	t.Helper()
+	return newTestServiceWith(t, ContainerProviderConfig{BinaryPath: testBinary(t)})
+}
+
+func newTestServiceWith(t *testing.T, config ContainerProviderConfig) *ContainerService {
+	t.Helper()
+	sm := New(ContainerProviderConfig{
+		DataRoot:          t.TempDir(),
+		BinaryPath:        config.BinaryPath,
+		Binaries:          config.Binaries,
+		StartTimeout:      10 * time.Second,
+		StopTimeout:       2 * time.Second,
+		RestartBackoff:    10 * time.Millisecond,
+		MaxRestartBackoff: time.Second,
+		MaxRestarts:       2,
+		Cgroups:           config.Cgroups,
+	})
+	t.Cleanup(func() {
+		for _, id := range sm.ContainerIds() {
+			sm.StopContainer(id)
+		}
+	})
+	return sm
+}
+
+func get(t *testing.T, container ioc.IContainer, path string) (string, error) {
+	t.Helper()
+	resp, err := http.Get(container.Url().JoinPath(path).String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func eventually(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestContainerRunsWithOnlyInstanceSecrets(t *testing.T) {
+	t.Setenv("POCKER_ONLY", "leaked")
+	sm := newTestService(t)
+
+	container, err := sm.GetOrCreateContainer(newDeployment("env", map[string]string{"API_KEY": "s3cret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Release()
+
+	body, err := get(t, container, "/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env []string
+	if err := json.Unmarshal([]byte(body), &env); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"API_KEY=s3cret", fakePocketBaseSecret + "=1"}
+	if strings.Join(env, ",") != strings.Join(want, ",") {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+}
+
+func TestStopContainerKillsProcess(t *testing.T) {
+	sm := newTestService(t)
+
+	container, err := sm.GetOrCreateContainer(newDeployment("stop", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Release()
+
+	if !sm.StopContainer("stop") {
+		t.Fatal("StopContainer() = false, want true")
+	}
+	if _, err := get(t, container, "/api/health"); err == nil {
+		t.Error("process still answering after StopContainer()")
+	}
+	if _, ok := sm.GetContainer("stop"); ok {
+		t.Error("container still registered after StopContainer()")
+	}
+}
+
+func TestCrashedProcessIsRestarted(t *testing.T) {
+	sm := newTestService(t)
+
+	container, err := sm.GetOrCreateContainer(newDeployment("crash", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Release()
+
+	firstPid, err := get(t, container, "/pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(t, container, "/crash")
+
+	eventually(t, "a restarted process", func() bool {
+		pid, err := get(t, container, "/pid")
+		return err == nil && pid != firstPid
+	})
+	if _, ok := sm.GetContainer("crash"); !ok {
+		t.Error("container evicted after a single crash")
+	}
+	if !strings.Contains(container.(*Container).output.String(), "fake pocketbase listening") {
+		t.Errorf("output not captured, got %q", container.(*Container).output.String())
+	}
+}
+
+func TestContainerEvictedAfterRepeatedCrashes(t *testing.T) {
+	sm := newTestService(t)
+
+	container, err := sm.GetOrCreateContainer(newDeployment("flaky", map[string]string{"EXIT_AFTER": "200ms"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Release()
+
+	eventually(t, "the container to be evicted", func() bool {
+		_, ok := sm.GetContainer("flaky")
+		return !ok
+	})
+}
+
+func TestStartFailureReportsOutput(t *testing.T) {
+	sm := newTestService(t)
+
+	_, err := sm.GetOrCreateContainer(newDeployment("broken", map[string]string{"CRASH_ON_START": "bad migration"}))
+	if err == nil {
+		t.Fatal("GetOrCreateContainer() succeeded, want error")
+	}
+	if !strings.Contains(err.Error(), "bad migration") {
+		t.Errorf("error %q doesn't include the process output", err)
+	}
+	if ids := sm.ContainerIds(); len(ids) != 0 {
+		t.Errorf("ContainerIds() = %v, want none", ids)
+	}
+}
+
+func TestContainerRunsRequestedVersion(t *testing.T) {
+	sm := newTestServiceWith(t, ContainerProviderConfig{
+		Binaries: fakeBinaries{"0.23.4": testBinary(t)},
+	})
+
+	deployment := newDeployment("pinned", nil)
+	deployment.version = "0.23.4"
+	container, err := sm.GetOrCreateContainer(deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Release()
+	if container.(*Container).binary != testBinary(t) {
+		t.Errorf("binary = %s, want %s", container.(*Container).binary, testBinary(t))
+	}
+
+	deployment = newDeployment("unavailable", nil)
+	deployment.version = "0.99.0"
+	_, err = sm.GetOrCreateContainer(deployment)
+	if !errors.Is(err, ioc.ErrVersionUnavailable) {
+		t.Errorf("GetOrCreateContainer() error = %v, want ErrVersionUnavailable", err)
+	}
+
+	// Without a default binary, an instance has to ask for a version
+	_, err = sm.GetOrCreateContainer(newDeployment("unversioned", nil))
+	if !errors.Is(err, ioc.ErrVersionUnavailable) {
+		t.Errorf("GetOrCreateContainer() error = %v, want ErrVersionUnavailable", err)
+	}
+}
@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"pocker/core/metrics"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons a request can be turned away by the concurrency limiter
+const (
+	concurrencyRejectedQueueFull   = "queue_full"
+	concurrencyRejectedTimeout     = "timeout"
+	concurrencyRejectedStreamsFull = "streams_full"
+)
+
+// realtimePath is PocketBase's SSE endpoint
+const realtimePath = "/api/realtime"
+
+var (
+	concurrencyRejectedTotal = metrics.NewCounterVec("pocker_concurrency_rejected_total",
+		"Requests turned away by the per-instance concurrency limiter, by reason.",
+		"reason")
+
+	concurrencyLimitersMu sync.Mutex
+	concurrencyLimiters   []*concurrencyLimiter
+	streamLimiters        []*concurrencyLimiter
+)
+
+func init() {
+	metrics.NewGaugeVecFunc("pocker_instance_queue_depth",
+		"Requests waiting for a concurrency slot, by instance. Instances without a queue are omitted.",
+		"instance_id",
+		func() map[string]float64 {
+			depths := map[string]float64{}
+			concurrencyLimitersMu.Lock()
+			defer concurrencyLimitersMu.Unlock()
+			for _, limiter := range concurrencyLimiters {
+				limiter.queueDepths(depths)
+			}
+			return depths
+		})
+	metrics.NewGaugeFunc("pocker_instance_requests_in_flight",
+		"Requests holding a concurrency slot across all instances.",
+		func() float64 {
+			total := 0
+			concurrencyLimitersMu.Lock()
+			defer concurrencyLimitersMu.Unlock()
+			for _, limiter := range concurrencyLimiters {
+				total += limiter.inFlight()
+			}
+			return float64(total)
+		})
+	metrics.NewGaugeFunc("pocker_instance_streams_open",
+		"SSE streams and upgraded connections holding a stream slot across all instances.",
+		func() float64 {
+			total := 0
+			concurrencyLimitersMu.Lock()
+			defer concurrencyLimitersMu.Unlock()
+			for _, limiter := range streamLimiters {
+				total += limiter.inFlight()
+			}
+			return float64(total)
+		})
+}
+
+type ConcurrencyLimitConfig struct {
+	// MaxInFlight is how many requests one instance may have proxied at
+	// once. Defaults to 50.
+	MaxInFlight int
+	// MaxQueue is how many more requests may wait for a slot before new
+	// ones are rejected. Defaults to 100.
+	MaxQueue int
+	// QueueTimeout is how long a request waits for a slot. Defaults to 10s.
+	QueueTimeout time.Duration
+	// MaxStreams is how many SSE streams and upgraded connections one
+	// instance may hold open. They are capped apart from other requests and
+	// never queue. Defaults to 200.
+	MaxStreams int
+}
+
+// instanceSlots tracks one instance's requests. Waiters are served in
+// arrival order; a released slot is handed straight to the first of them.
+type instanceSlots struct {
+	inFlight int
+	queue    []chan struct{}
+}
+
+type concurrencyLimiter struct {
+	config ConcurrencyLimitConfig
+	// noQueue rejects requests as soon as the slots are taken
+	noQueue   bool
+	mu        sync.Mutex
+	instances map[string]*instanceSlots
+}
+
+func newConcurrencyLimiter(config ConcurrencyLimitConfig) *concurrencyLimiter {
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 50
+	}
+	if config.MaxQueue == 0 {
+		config.MaxQueue = 100
+	}
+	if config.QueueTimeout == 0 {
+		config.QueueTimeout = 10 * time.Second
+	}
+	if config.MaxStreams == 0 {
+		config.MaxStreams = 200
+	}
+	return &concurrencyLimiter{
+		config:    config,
+		instances: map[string]*instanceSlots{},
+	}
+}
+
+// acquire waits for a slot for the instance. It returns an empty reason once
+// the caller holds a slot, which it must give back with release.
+func (l *concurrencyLimiter) acquire(instanceId string, done <-chan struct{}) string {
+	l.mu.Lock()
+	slots, ok := l.instances[instanceId]
+	if !ok {
+		slots = &instanceSlots{}
+		l.instances[instanceId] = slots
+	}
+	if slots.inFlight < l.config.MaxInFlight {
+		slots.inFlight++
+		l.mu.Unlock()
+		return ""
+	}
+	if l.noQueue {
+		l.mu.Unlock()
+		return concurrencyRejectedStreamsFull
+	}
+	if len(slots.queue) >= l.config.MaxQueue {
+		l.mu.Unlock()
+		return concurrencyRejectedQueueFull
+	}
+	granted := make(chan struct{})
+	slots.queue = append(slots.queue, granted)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-granted:
+		return ""
+	case <-timer.C:
+	case <-done:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiter := range slots.queue {
+		if waiter == granted {
+			slots.queue = append(slots.queue[:i], slots.queue[i+1:]...)
+			return concurrencyRejectedTimeout
+		}
+	}
+	// The slot was handed over while giving up; keep it
+	return ""
+}
+
+func (l *concurrencyLimiter) release(instanceId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots := l.instances[instanceId]
+	if len(slots.queue) > 0 {
+		next := slots.queue[0]
+		slots.queue = slots.queue[1:]
+		close(next)
+		return
+	}
+	slots.inFlight--
+	if slots.inFlight == 0 {
+		delete(l.instances, instanceId)
+	}
+}
+
+func (l *concurrencyLimiter) queueDepths(depths map[string]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for instanceId, slots := range l.instances {
+		if len(slots.queue) > 0 {
+			depths[instanceId] += float64(len(slots.queue))
+		}
+	}
+}
+
+func (l *concurrencyLimiter) inFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	for _, slots := range l.instances {
+		total += slots.inFlight
+	}
+	return total
+}
+
+// newStreamLimiter caps long-lived streams. They would lock out ordinary
+// requests if they held request slots for their lifetime, so they get
+// slots of their own.
+func newStreamLimiter(config ConcurrencyLimitConfig) *concurrencyLimiter {
+	limiter := newConcurrencyLimiter(config)
+	limiter.config.MaxInFlight = limiter.config.MaxStreams
+	limiter.noQueue = true
+	return limiter
+}
+
+// isStreaming reports whether a request is for PocketBase's realtime SSE
+// endpoint or asks to upgrade the connection. It goes by the route and not
+// by Accept, so a client can't opt an ordinary request out of the request
+// cap. One that sends Upgrade anyway only takes a stream slot.
+func isStreaming(r *http.Request) bool {
+	return (r.Method == http.MethodGet && r.URL.Path == realtimePath) ||
+		r.Header.Get("Upgrade") != ""
+}
+
+// ConcurrencyLimitMiddleware caps how many requests each instance may have
+// in flight, queueing the overflow for a bounded time so one tenant's slow
+// hooks can't tie up the connections every instance shares. Streams are
+// capped separately and never queue. Add it to ProxyConfig.PockerMiddlewares.
+func ConcurrencyLimitMiddleware(config ConcurrencyLimitConfig) gin.HandlerFunc {
+	requests := newConcurrencyLimiter(config)
+	streams := newStreamLimiter(config)
+	concurrencyLimitersMu.Lock()
+	concurrencyLimiters = append(concurrencyLimiters, requests)
+	streamLimiters = append(streamLimiters, streams)
+	concurrencyLimitersMu.Unlock()
+
+	return func(c *gin.Context) {
+		deployment, err := ResolveDeployment(c)
+		if err != nil {
+			c.Next()
+			return
+		}
+
+		limiter := requests
+		if isStreaming(c.Request) {
+			limiter = streams
+		}
+		instanceId := deployment.InstanceId()
+		reason := limiter.acquire(instanceId, c.Request.Context().Done())
+		if reason != "" {
+			if c.Request.Context().Err() != nil {
+				// Nobody is left to read a response
+				c.Abort()
+				return
+			}
+			concurrencyRejectedTotal.Inc(reason)
+			slog.Debug("Concurrency limit reached",
+				"instance_id", instanceId,
+				"reason", reason)
+			c.Header("Retry-After", "1")
+			abortWithError(c, http.StatusServiceUnavailable, "This instance is handling too many requests. Please try again shortly.")
+			return
+		}
+		defer limiter.release(instanceId)
+		c.Next()
+	}
+}
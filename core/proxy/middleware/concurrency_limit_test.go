@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := newConcurrencyLimiter(ConcurrencyLimitConfig{
+		MaxInFlight:  2,
+		MaxQueue:     1,
+		QueueTimeout: 50 * time.Millisecond,
+	})
+
+	for i := range 2 {
+		if reason := limiter.acquire("a", nil); reason != "" {
+			t.Fatalf("request %d was rejected: %s", i, reason)
+		}
+	}
+
+	// Other instances are unaffected
+	if reason := limiter.acquire("b", nil); reason != "" {
+		t.Fatalf("other instance was rejected: %s", reason)
+	}
+	limiter.release("b")
+
+	// A queued request times out when no slot frees up
+	if reason := limiter.acquire("a", nil); reason != concurrencyRejectedTimeout {
+		t.Fatalf("reason = %q, want %s", reason, concurrencyRejectedTimeout)
+	}
+
+	// A queued request gets the next released slot
+	waited := make(chan string)
+	go func() {
+		waited <- limiter.acquire("a", nil)
+	}()
+	waitForQueue(t, limiter, "a", 1)
+
+	if reason := limiter.acquire("a", nil); reason != concurrencyRejectedQueueFull {
+		t.Fatalf("reason = %q, want %s", reason, concurrencyRejectedQueueFull)
+	}
+
+	limiter.release("a")
+	if reason := <-waited; reason != "" {
+		t.Fatalf("queued request was rejected: %s", reason)
+	}
+	if got := limiter.inFlight(); got != 2 {
+		t.Fatalf("inFlight = %d, want 2", got)
+	}
+
+	limiter.release("a")
+	limiter.release("a")
+	if len(limiter.instances) != 0 {
+		t.Fatalf("idle instances were not forgotten: %v", limiter.instances)
+	}
+}
+
+func TestConcurrencyLimiterGivesUpWhenClientLeaves(t *testing.T) {
+	limiter := newConcurrencyLimiter(ConcurrencyLimitConfig{MaxInFlight: 1, QueueTimeout: time.Minute})
+	limiter.acquire("a", nil)
+
+	done := make(chan struct{})
+	close(done)
+	if reason := limiter.acquire("a", done); reason == "" {
+		t.Fatal("expected the waiter to give up")
+	}
+	depths := map[string]float64{}
+	limiter.queueDepths(depths)
+	if len(depths) != 0 {
+		t.Fatalf("abandoned waiter left in queue: %v", depths)
+	}
+}
+
+func waitForQueue(t *testing.T, limiter *concurrencyLimiter, instanceId string, depth int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		depths := map[string]float64{}
+		limiter.queueDepths(depths)
+		if depths[instanceId] == float64(depth) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("queue for %s never reached %d", instanceId, depth)
+}
+
+func TestStreamLimiterDoesNotQueue(t *testing.T) {
+	limiter := newStreamLimiter(ConcurrencyLimitConfig{MaxInFlight: 1, MaxStreams: 2})
+
+	for i := range 2 {
+		if reason := limiter.acquire("a", nil); reason != "" {
+			t.Fatalf("stream %d was rejected: %s", i, reason)
+		}
+	}
+	if reason := limiter.acquire("a", nil); reason != concurrencyRejectedStreamsFull {
+		t.Fatalf("reason = %q, want %s", reason, concurrencyRejectedStreamsFull)
+	}
+}
+
+func TestIsStreamingIgnoresAcceptHeader(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		header http.Header
+		want   bool
+	}{
+		{http.MethodGet, "/api/realtime", nil, true},
+		{http.MethodPost, "/api/realtime", nil, false},
+		{http.MethodGet, "/ws", http.Header{"Upgrade": {"websocket"}}, true},
+		{http.MethodGet, "/api/collections/posts/records", http.Header{"Accept": {"text/event-stream"}}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		for key, values := range tt.header {
+			req.Header[key] = values
+		}
+		if got := isStreaming(req); got != tt.want {
+			t.Errorf("isStreaming(%s %s %v) = %v, want %v", tt.method, tt.path, tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	_ "embed"
+)
+
+//go:embed recovery.html
+var recoveryTemplate string
+
+var errorTemplate = template.Must(template.New("error").Parse(recoveryTemplate))
+
+type errorResponse struct {
+	Error     interface{} `json:"error"`
+	Signature string      `json:"signature"`
+}
+
+// writeError renders an error response in the format requested by the
+// client's Accept header (JSON, plain text, or the HTML error page).
+func writeError(w http.ResponseWriter, r *http.Request, status int, err interface{}) {
+	signature := fmt.Sprintf("%s-%s", r.URL.Path, err)
+
+	// Get Accept header and default to HTML if not specified
+	accept := r.Header.Get("Accept")
+
+	// Return format based on Accept header
+	switch {
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(errorResponse{
+			Error:     fmt.Sprintf("%v", err),
+			Signature: signature,
+		})
+
+	case strings.Contains(accept, "text/plain"):
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s: %s", http.StatusText(status), signature)
+
+	default: // HTML response
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		errorTemplate.Execute(w, gin.H{
+			"error":     err,
+			"signature": signature,
+		})
+	}
+}
+
+// abortWithError writes an error response and stops the handler chain.
+func abortWithError(c *gin.Context, status int, err interface{}) {
+	writeError(c.Writer, c.Request, status, err)
+	c.Abort()
+}
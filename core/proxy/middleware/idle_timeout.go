@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errUpstreamIdle wraps context.DeadlineExceeded so an idle upstream is
+// reported as a timeout rather than a client cancellation
+var errUpstreamIdle = fmt.Errorf("upstream connection idle: %w", context.DeadlineExceeded)
+
+// idleTimeoutTransport cuts off an upstream exchange once no bytes have moved
+// for timeout: while waiting for the response, while streaming its body, and
+// in either direction of an upgraded connection. Unlike a fixed deadline it
+// never interrupts a busy SSE stream or WebSocket.
+type idleTimeoutTransport struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+// withIdleTimeout wraps transport, or returns it unchanged when timeout is
+// not positive
+func withIdleTimeout(transport http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return transport
+	}
+	return &idleTimeoutTransport{transport: transport, timeout: timeout}
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	idle := &idleTimer{timeout: t.timeout, cancel: cancel}
+	idle.timer = time.AfterFunc(t.timeout, idle.expire)
+
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		idle.stop()
+		if idle.expired.Load() {
+			return nil, errUpstreamIdle
+		}
+		return nil, err
+	}
+
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		// Canceling the context doesn't reach a connection that was handed
+		// off, so expiry closes it directly
+		idle.conn.Store(conn)
+		resp.Body = &idleConn{ReadWriteCloser: conn, idle: idle}
+		return resp, nil
+	}
+	resp.Body = &idleBody{ReadCloser: resp.Body, idle: idle}
+	return resp, nil
+}
+
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+	conn    atomic.Value // io.Closer
+	expired atomic.Bool
+}
+
+func (t *idleTimer) expire() {
+	t.expired.Store(true)
+	t.cancel()
+	if conn, ok := t.conn.Load().(io.Closer); ok {
+		conn.Close()
+	}
+}
+
+func (t *idleTimer) touch() {
+	t.timer.Reset(t.timeout)
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+	t.cancel()
+}
+
+// err reports an idle expiry in place of the error it caused
+func (t *idleTimer) err(err error) error {
+	if err != nil && err != io.EOF && t.expired.Load() {
+		return errUpstreamIdle
+	}
+	return err
+}
+
+type idleBody struct {
+	io.ReadCloser
+	idle *idleTimer
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.idle.touch()
+	}
+	return n, b.idle.err(err)
+}
+
+func (b *idleBody) Close() error {
+	b.idle.stop()
+	return b.ReadCloser.Close()
+}
+
+type idleConn struct {
+	io.ReadWriteCloser
+	idle *idleTimer
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, c.idle.err(err)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.idle.touch()
+	}
+	return n, c.idle.err(err)
+}
+
+func (c *idleConn) Close() error {
+	c.idle.stop()
+	return c.ReadWriteCloser.Close()
+}
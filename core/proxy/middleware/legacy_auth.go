@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LegacySignatureHeader carries a signed, time-bound proof that a request
+// was forwarded to the legacy origin helper by another Pocker machine.
+//
+// The signature covers no nonce and no body, so a captured request can be
+// replayed, with any body, until it is LegacySignatureMaxAge old. It is only
+// meant to be sent over 6PN to the helper's private listener.
+const LegacySignatureHeader = "X-PocketHost-Signature"
+
+// LegacySecretHeader carries the raw PH secret. It is only ever sent by the
+// legacy origin helper to the legacy origin itself.
+const LegacySecretHeader = "X-Pockethost-Secret"
+
+const defaultLegacySignatureMaxAge = 30 * time.Second
+
+var (
+	ErrLegacySignatureMalformed = errors.New("malformed legacy signature")
+	ErrLegacySignatureExpired   = errors.New("legacy signature expired")
+	ErrLegacySignatureInvalid   = errors.New("invalid legacy signature")
+)
+
+// ContextKeyLegacyForwardedBy holds the id of the machine that signed a
+// verified forwarded request
+const ContextKeyLegacyForwardedBy = "legacy_forwarded_by"
+
+func legacySignaturePayload(timestamp int64, method string, uri string, host string, machineId string) []byte {
+	return []byte(fmt.Sprintf("v2\n%d\n%s\n%s\n%s\n%s", timestamp, method, uri, strings.ToLower(host), machineId))
+}
+
+func legacyMac(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// signLegacyRequest returns a LegacySignatureHeader value binding the
+// request's method, URI and target host and the forwarding machine to the
+// current time
+func signLegacyRequest(secret string, r *http.Request, machineId string, now time.Time) string {
+	timestamp := now.Unix()
+	signature := legacyMac(secret, legacySignaturePayload(timestamp, r.Method, r.URL.RequestURI(), r.Host, machineId))
+	return fmt.Sprintf("t=%d,m=%s,s=%s", timestamp, machineId, hex.EncodeToString(signature))
+}
+
+// verifyLegacySignature checks a LegacySignatureHeader value against the
+// request and returns the id of the machine that signed it
+func verifyLegacySignature(secret string, value string, r *http.Request, now time.Time, maxAge time.Duration) (string, error) {
+	fields := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return "", ErrLegacySignatureMalformed
+		}
+		fields[key] = val
+	}
+
+	timestamp, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil {
+		return "", ErrLegacySignatureMalformed
+	}
+	machineId := fields["m"]
+	signature, err := hex.DecodeString(fields["s"])
+	if machineId == "" || err != nil || len(signature) != sha256.Size {
+		return "", ErrLegacySignatureMalformed
+	}
+
+	// Check the MAC before the clock so a forged header learns nothing
+	expected := legacyMac(secret, legacySignaturePayload(timestamp, r.Method, r.URL.RequestURI(), r.Host, machineId))
+	if !hmac.Equal(signature, expected) {
+		return "", ErrLegacySignatureInvalid
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > maxAge || age < -maxAge {
+		return "", ErrLegacySignatureExpired
+	}
+	return machineId, nil
+}
+
+// LegacyAuthMiddleware drops the PH secret header from public traffic and
+// refuses signed requests. Forwarded legacy traffic is only accepted by
+// LegacyForwardAuthMiddleware on the helper's private listener, so a signed
+// request here comes from a peer whose LegacyOriginHelperProxyUrl still points
+// at the helper's public listener.
+func LegacyAuthMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(LegacySecretHeader)
+		if c.Request.Header.Get(LegacySignatureHeader) != "" {
+			slog.Warn("Refused forwarded legacy request on the public listener",
+				"host", c.Request.Host,
+				"remote_addr", c.Request.RemoteAddr)
+			abortWithError(c, http.StatusMisdirectedRequest, "Forwarded legacy traffic must be sent to the helper's private listener.")
+			return
+		}
+		c.Next()
+	}
+}
+
+// LegacyForwardAuthMiddleware guards the legacy origin helper's private
+// listener. Every request must carry a valid signature from another machine,
+// or it is rejected before PockerMiddleware adds the PH secret.
+func LegacyForwardAuthMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
+	maxAge := config.LegacySignatureMaxAge
+	if maxAge == 0 {
+		maxAge = defaultLegacySignatureMaxAge
+	}
+
+	return func(c *gin.Context) {
+		c.Request.Header.Del(LegacySecretHeader)
+
+		value := c.Request.Header.Get(LegacySignatureHeader)
+		c.Request.Header.Del(LegacySignatureHeader)
+
+		machineId, err := verifyLegacySignature(config.PHSecret, value, c.Request, time.Now(), maxAge)
+		if err != nil {
+			slog.Warn("Rejected forwarded legacy request",
+				"host", c.Request.Host,
+				"remote_addr", c.Request.RemoteAddr,
+				"error", err)
+			abortWithError(c, http.StatusUnauthorized, "Invalid forwarding signature.")
+			return
+		}
+
+		c.Set(ContextKeyLegacyForwardedBy, machineId)
+		c.Next()
+	}
+}
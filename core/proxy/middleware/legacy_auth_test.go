@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLegacySignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	request := func(method string, target string) *http.Request {
+		return httptest.NewRequest(method, target, nil)
+	}
+	value := signLegacyRequest("secret", request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), "machine-1", now)
+
+	tests := []struct {
+		name    string
+		secret  string
+		value   string
+		request *http.Request
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", secret: "secret", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now},
+		{name: "host is case insensitive", secret: "secret", value: value, request: request(http.MethodGet, "http://App.PocketHost.io/api/health?x=1"), now: now.Add(10 * time.Second)},
+		{name: "wrong secret", secret: "other", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "wrong host", secret: "secret", value: value, request: request(http.MethodGet, "http://evil.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "wrong method", secret: "secret", value: value, request: request(http.MethodDelete, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "wrong path", secret: "secret", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/admins?x=1"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "wrong query", secret: "secret", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=2"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "tampered machine", secret: "secret", value: strings.Replace(value, "m=machine-1", "m=machine-2", 1), request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureInvalid},
+		{name: "expired", secret: "secret", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now.Add(time.Minute), wantErr: ErrLegacySignatureExpired},
+		{name: "from the future", secret: "secret", value: value, request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now.Add(-time.Minute), wantErr: ErrLegacySignatureExpired},
+		{name: "malformed", secret: "secret", value: "secret", request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureMalformed},
+		{name: "missing", secret: "secret", value: "", request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureMalformed},
+		{name: "missing signature", secret: "secret", value: "t=1700000000,m=machine-1", request: request(http.MethodGet, "http://app.pockethost.io/api/health?x=1"), now: now, wantErr: ErrLegacySignatureMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			machineId, err := verifyLegacySignature(tt.secret, tt.value, tt.request, tt.now, 30*time.Second)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && machineId != "machine-1" {
+				t.Fatalf("machineId = %q", machineId)
+			}
+		})
+	}
+}
+
+func TestPublicListenerRefusesForwardedLegacyTraffic(t *testing.T) {
+	r := gin.New()
+	r.Use(LegacyAuthMiddleware(PockerMiddlewareConfig{}))
+	r.GET("/", func(c *gin.Context) {
+		if c.Request.Header.Get(LegacySecretHeader) != "" {
+			t.Error("PH secret reached the handler")
+		}
+		c.Status(http.StatusOK)
+	})
+
+	serve := func(header string, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://app.pockethost.io/", nil)
+		req.Header.Set(header, value)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if status := serve(LegacySignatureHeader, "t=1,m=peer,s=00"); status != http.StatusMisdirectedRequest {
+		t.Errorf("signed request: status = %d, want 421", status)
+	}
+	if status := serve(LegacySecretHeader, "secret"); status != http.StatusOK {
+		t.Errorf("request with secret: status = %d, want 200", status)
+	}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"pocker/core/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route types a deployment request can take through PockerMiddleware
+const (
+	routeLegacy   = "legacy"
+	routeLocal    = "local"
+	routeNeighbor = "neighbor"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("pocker_requests_total",
+		"Requests routed to a deployment, by route type and status code.",
+		"route", "code")
+	requestDuration = metrics.NewHistogramVec("pocker_request_duration_seconds",
+		"Time spent serving a deployment request, by route type.",
+		metrics.DefaultBuckets, "route")
+	upstreamErrorsTotal = metrics.NewCounterVec("pocker_upstream_errors_total",
+		"Requests that failed to reach their upstream, by upstream and failure reason.",
+		"upstream", "reason")
+)
+
+func observeRequest(c *gin.Context, route string, start time.Time) {
+	requestsTotal.Inc(route, strconv.Itoa(c.Writer.Status()))
+	requestDuration.Observe(time.Since(start).Seconds(), route)
+}
@@ -1,40 +1,97 @@
 package middleware
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"pocker/core/ioc"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ForwardedByHeader carries the id of the machine that forwarded a request to
+// the neighbor owning the deployment.
+const ForwardedByHeader = "X-PocketHost-Forwarded-By"
+
+const defaultIdleTimeout = 15 * time.Minute
+
+// ContextKeyDeployment holds the deployment resolved for the request host
+const ContextKeyDeployment = "deployment"
+
+// ResolveDeployment looks up the deployment for the request host once per
+// request, so PockerMiddlewares and PockerMiddleware share the lookup
+func ResolveDeployment(c *gin.Context) (ioc.IDeployment, error) {
+	if deployment, ok := c.Get(ContextKeyDeployment); ok {
+		return deployment.(ioc.IDeployment), nil
+	}
+	deployment, err := ioc.MothershipService().GetDeploymentByIdentifier(c.Request.Host)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(ContextKeyDeployment, deployment)
+	return deployment, nil
+}
+
 type PockerMiddlewareConfig struct {
-	LegacyOriginUrl             string
-	LegacyOriginHelperProxyUrl  string
+	LegacyOriginUrl string
+	// LegacyOriginUrls are extra legacy origins balanced with LegacyOriginUrl
+	LegacyOriginUrls []string
+	// LegacyOriginHelperProxyUrl is the helper's private listener, where
+	// it accepts signed legacy traffic from the other machines
+	LegacyOriginHelperProxyUrl string
+	// LegacyOriginHelperProxyUrls are extra helper proxies balanced with
+	// LegacyOriginHelperProxyUrl
+	LegacyOriginHelperProxyUrls []string
+	// LegacyBalancing is BalancingRoundRobin (default) or
+	// BalancingLeastConnection
+	LegacyBalancing           string
+	LegacyHealthCheckInterval time.Duration
+	// Idle timeouts close a proxied exchange, including SSE streams and
+	// WebSockets, after no bytes have moved for that long. Default 15m; a
+	// negative value disables the timeout.
+	LegacyIdleTimeout   time.Duration
+	LocalIdleTimeout    time.Duration
+	NeighborIdleTimeout time.Duration
+	// LegacyTLS controls verification of HTTPS legacy origins
+	LegacyTLS UpstreamTLSConfig
+	// LegacySignatureMaxAge bounds the clock skew and delay accepted on
+	// requests forwarded to the legacy origin helper
+	LegacySignatureMaxAge       time.Duration
 	LegacyApexDomain            string
 	LegacyOriginHelperMachineId string
 	PHSecret                    string
 }
 
-// Modify handleRequest to be the core handler without middleware
-func PockerMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
-	legacyOriginUrl, err := url.Parse(config.LegacyOriginUrl)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to parse legacy origin url: %s", err))
+func (config PockerMiddlewareConfig) legacyOriginUrls() []string {
+	return nonEmpty(append([]string{config.LegacyOriginUrl}, config.LegacyOriginUrls...))
+}
+
+func (config PockerMiddlewareConfig) legacyOriginHelperProxyUrls() []string {
+	return nonEmpty(append([]string{config.LegacyOriginHelperProxyUrl}, config.LegacyOriginHelperProxyUrls...))
+}
+
+func idleTimeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return defaultIdleTimeout
 	}
+	return timeout
+}
 
-	legacyOriginHelperProxyUrl, err := url.Parse(config.LegacyOriginHelperProxyUrl)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to parse legacy origin helper proxy url: %s", err))
+func nonEmpty(values []string) []string {
+	result := []string{}
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
 	}
-	slog.Debug("Legacy origin helper proxy url", "url", legacyOriginHelperProxyUrl)
+	return result
+}
 
+// Modify handleRequest to be the core handler without middleware
+func PockerMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
 	legacyApexDomain := config.LegacyApexDomain
 	if legacyApexDomain == "" {
 		panic("Legacy apex domain is required")
@@ -53,83 +110,140 @@ func PockerMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
 	thisMachineId := ioc.MachineInfoService().MachineId()
 	isLegacyOriginHelper := thisMachineId == legacyOriginHelperMachineId
 
-	mothershipApi := ioc.MothershipService()
+	legacyTLSConfig, err := config.LegacyTLS.tlsConfig()
+	if err != nil {
+		panic(fmt.Sprintf("Invalid legacy TLS config: %s", err))
+	}
 
-	// Configure proxy with custom transport that skips TLS verification
+	// Both legacy proxies carry the PH secret, so they share one verified
+	// transport
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig:     legacyTLSConfig,
 		MaxIdleConns:        100000,
 		MaxConnsPerHost:     1000,
 		MaxIdleConnsPerHost: 1000,
 		IdleConnTimeout:     5 * time.Minute,
 	}
 
+	healthCheckInterval := config.LegacyHealthCheckInterval
+	if healthCheckInterval == 0 {
+		healthCheckInterval = 10 * time.Second
+	}
+
 	// ================================================
 	// Create proxy URL
 	// ================================================
-	legacyProxy := httputil.NewSingleHostReverseProxy(legacyOriginUrl)
-	legacyProxy.Transport = transport
-	legacyProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		slog.Warn("Inside legacyproxy error handler", "error", err)
+	legacyPool, err := newUpstreamPool("legacy", config.legacyOriginUrls(), config.LegacyBalancing, transport)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create legacy origin pool: %s", err))
 	}
+	legacyProxy := newPoolProxy(legacyPool)
+	legacyProxy.Transport = withIdleTimeout(legacyPool, idleTimeoutOrDefault(config.LegacyIdleTimeout))
+	legacyProxy.ErrorHandler = upstreamErrorHandler("legacy", "Could not reach the legacy origin. Please try again later.")
 
-	legacyHelperProxy := httputil.NewSingleHostReverseProxy(legacyOriginHelperProxyUrl)
-	legacyHelperProxy.Transport = transport
-	legacyHelperProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		slog.Warn("Inside legacy helper proxy error handler", "error", err)
+	legacyHelperPool, err := newUpstreamPool("legacy_helper", config.legacyOriginHelperProxyUrls(), config.LegacyBalancing, transport)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create legacy origin helper proxy pool: %s", err))
 	}
+	slog.Debug("Legacy origin helper proxy urls", "urls", config.legacyOriginHelperProxyUrls())
+	legacyHelperProxy := newPoolProxy(legacyHelperPool)
+	legacyHelperProxy.Transport = withIdleTimeout(legacyHelperPool, idleTimeoutOrDefault(config.LegacyIdleTimeout))
+	legacyHelperProxy.ErrorHandler = upstreamErrorHandler("legacy_helper", "Could not reach the legacy origin. Please try again later.")
 
-	handleLegacy := func(c *gin.Context, deployment ioc.IDeployment) {
-		host := strings.Split(c.Request.Host, ":")[0]
-		// slog.Debug("Received request from host", "host", host)
+	// Only the pool this machine actually forwards to needs watching
+	if isLegacyOriginHelper {
+		legacyPool.StartHealthChecks(healthCheckInterval)
+	} else {
+		legacyHelperPool.StartHealthChecks(healthCheckInterval)
+	}
 
-		subdomain := strings.Split(host, ".")[0]
-		finalHost := fmt.Sprintf("%s.%s", subdomain, legacyApexDomain)
+	handleLegacy := func(c *gin.Context, deployment ioc.IDeployment) {
+		// The legacy origin only knows instances by subdomain, so cname
+		// hosts are rewritten too
+		finalHost := fmt.Sprintf("%s.%s", deployment.Subdomain(), legacyApexDomain)
 		c.Request.Host = finalHost
 		c.Request.Header.Set("Host", finalHost)
 
 		// logRequest("Modified request", c)
 		// slog.Debug("Proxy URL", "url", proxyUrl)
 
-		c.Request.Header.Set("X-Pockethost-Secret", secret)
-
 		if !isLegacyOriginHelper {
 			// slog.Debug("Machine id is not the legacy origin helper machine id, using legacy origin helper machine", "machine_id", thisMachineId)
+			// The raw secret never leaves this machine; the helper checks the
+			// signature with LegacyAuthMiddleware
+			c.Request.Header.Set(LegacySignatureHeader, signLegacyRequest(secret, c.Request, thisMachineId, time.Now()))
 			legacyHelperProxy.ServeHTTP(c.Writer, c.Request)
 		} else {
 			// slog.Debug("Machine id is the legacy origin helper machine id", "machine_id", thisMachineId)
+			c.Request.Header.Set(LegacySecretHeader, secret)
 			legacyProxy.ServeHTTP(c.Writer, c.Request)
 		}
 	}
 
+	// Containers listen on loopback, so they get their own plain transport
+	// rather than sharing the one used for the legacy origin
+	localTransport := withIdleTimeout(&http.Transport{
+		MaxIdleConns:        100000,
+		MaxIdleConnsPerHost: 1000,
+		IdleConnTimeout:     5 * time.Minute,
+	}, idleTimeoutOrDefault(config.LocalIdleTimeout))
+
 	handleLocal := func(c *gin.Context, deployment ioc.IDeployment) {
-		panic("handle local")
 		// ================================================
 		// At this point, we are local, so we need to get or create a PocketBase instance
 		// ================================================
-		// container, err := ioc.ContainerService().GetOrCreateContainer(deployment)
-		// if err != nil {
-		// 	c.String(http.StatusNotFound, "Could not launch PocketBase instance. Please try again later.")
-		// 	c.Abort()
-		// 	return
-		// }
+		container, err := ioc.ContainerService().GetOrCreateContainer(deployment)
+		if err != nil {
+			slog.Error("Failed to launch container",
+				"instance_id", deployment.InstanceId(),
+				"error", err)
+			if errors.Is(err, ioc.ErrVersionUnavailable) {
+				abortWithError(c, http.StatusServiceUnavailable, fmt.Sprintf("PocketBase version %s is not available.", deployment.Version()))
+				return
+			}
+			abortWithError(c, http.StatusServiceUnavailable, "Could not launch PocketBase instance. Please try again later.")
+			return
+		}
+		defer container.Release()
 
-		// proxy := httputil.NewSingleHostReverseProxy(container.Url())
-		// proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		// 	panic(err)
-		// }
-		// proxy.ServeHTTP(c.Writer, c.Request)
+		proxy := httputil.NewSingleHostReverseProxy(container.Url())
+		proxy.Transport = localTransport
+		proxy.ErrorHandler = upstreamErrorHandler(routeLocal, "PocketBase instance is not responding. Please try again later.")
+		proxy.ServeHTTP(c.Writer, c.Request)
 	}
 
+	// Neighbors are reached over the private network, never TLS
+	neighborTransport := withIdleTimeout(&http.Transport{
+		MaxIdleConns:        100000,
+		MaxConnsPerHost:     1000,
+		MaxIdleConnsPerHost: 1000,
+		IdleConnTimeout:     5 * time.Minute,
+	}, idleTimeoutOrDefault(config.NeighborIdleTimeout))
+
 	handleNeighbor := func(c *gin.Context, deployment ioc.IDeployment) {
-		panic("Pass to neighbor")
-		// proxy := httputil.NewSingleHostReverseProxy(deployment.PrivateUrl())
-		// proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		// 	panic(err)
-		// }
-		// proxy.ServeHTTP(c.Writer, c.Request)
+		// A request that was already forwarded must be served by the receiving
+		// machine; forwarding it again means the machines disagree on ownership
+		if forwardedBy := c.Request.Header.Get(ForwardedByHeader); forwardedBy != "" {
+			slog.Error("Neighbor forwarding loop detected",
+				"instance_id", deployment.InstanceId(),
+				"machine_id", deployment.MachineId(),
+				"forwarded_by", forwardedBy)
+			abortWithError(c, http.StatusLoopDetected, "Instance routing loop detected. Please try again later.")
+			return
+		}
+
+		privateUrl := deployment.PrivateUrl()
+		if privateUrl == nil {
+			abortWithError(c, http.StatusBadGateway, "Could not locate the machine hosting this instance. Please try again later.")
+			return
+		}
+
+		c.Request.Header.Set(ForwardedByHeader, thisMachineId)
+
+		proxy := httputil.NewSingleHostReverseProxy(privateUrl)
+		proxy.Transport = neighborTransport
+		proxy.ErrorHandler = upstreamErrorHandler(routeNeighbor, "Could not reach the machine hosting this instance. Please try again later.")
+		proxy.ServeHTTP(c.Writer, c.Request)
 	}
 
 	// slog.Debug("Is legacy origin helper", "is_legacy_origin_helper", isLegacyOriginHelper)
@@ -147,7 +261,12 @@ func PockerMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
 		// 	c.Abort()
 		// 	return
 		// }
-		deployment, err := mothershipApi.GetDeploymentByIdentifier(c.Request.Host)
+		deployment, err := ResolveDeployment(c)
+		if errors.Is(err, ioc.ErrDeploymentNotFound) {
+			c.String(http.StatusNotFound, "Instance not found")
+			c.Abort()
+			return
+		}
 		if err != nil {
 			c.String(http.StatusServiceUnavailable, fmt.Sprintf("%s", err))
 			c.Abort()
@@ -194,17 +313,26 @@ func PockerMiddleware(config PockerMiddlewareConfig) gin.HandlerFunc {
 		// }
 
 		isLegacy := deployment.IsLegacy()
+		if _, forwarded := c.Get(ContextKeyLegacyForwardedBy); forwarded && !isLegacy {
+			// The private listener only relays legacy traffic to the origin
+			abortWithError(c, http.StatusMisdirectedRequest, "Forwarded request is not for a legacy instance.")
+			return
+		}
 		isLocal := deployment.MachineId() == thisMachineId
 		isNeighbor := !isLegacy && deployment.MachineId() != thisMachineId
 
+		start := time.Now()
 		if isLegacy {
 			handleLegacy(c, deployment)
+			observeRequest(c, routeLegacy, start)
 		}
 		if isLocal {
 			handleLocal(c, deployment)
+			observeRequest(c, routeLocal, start)
 		}
 		if isNeighbor {
 			handleNeighbor(c, deployment)
+			observeRequest(c, routeNeighbor, start)
 		}
 
 		c.Next()
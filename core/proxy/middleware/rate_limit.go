@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"pocker/core/metrics"
+	"pocker/core/syncx"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var rateLimitedTotal = metrics.NewCounterVec("pocker_rate_limited_total",
+	"Requests rejected by the per-instance rate limiter, by subscription tier.",
+	"tier")
+
+// RateLimit is a token bucket: RequestsPerSecond refill rate and up to Burst
+// requests at once. A zero RequestsPerSecond means unlimited.
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// ParseRateLimit reads a limit written as "<requests per second>/<burst>",
+// e.g. "20/40". The burst defaults to the rate rounded up.
+func ParseRateLimit(value string) (RateLimit, error) {
+	rateValue, burstValue, hasBurst := strings.Cut(strings.TrimSpace(value), "/")
+	rate, err := strconv.ParseFloat(rateValue, 64)
+	if err != nil || rate < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q", value)
+	}
+	limit := RateLimit{RequestsPerSecond: rate, Burst: int(math.Ceil(rate))}
+	if hasBurst {
+		burst, err := strconv.Atoi(burstValue)
+		if err != nil || burst < 1 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit burst %q", value)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// ParseRateLimitTiers parses a tier to limit map, such as one read from
+// RATE_LIMIT_TIERS="free:10/20,premium:50/100"
+func ParseRateLimitTiers(tiers map[string]string) (map[string]RateLimit, error) {
+	result := map[string]RateLimit{}
+	for tier, value := range tiers {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %w", tier, err)
+		}
+		result[tier] = limit
+	}
+	return result, nil
+}
+
+type RateLimitConfig struct {
+	// Tiers maps a User.Subscription value to the limit of its instances
+	Tiers map[string]RateLimit
+	// Default applies to subscriptions missing from Tiers
+	Default RateLimit
+	// PerClientIp gives every client IP its own bucket per instance rather
+	// than sharing one bucket across the instance
+	PerClientIp bool
+	// BucketTtl drops buckets that have not been used for this long.
+	// Defaults to 10m.
+	BucketTtl time.Duration
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	lastSeen time.Time
+}
+
+// take spends a token if one is available, otherwise reports how long until
+// the next one is
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	burst := float64(max(limit.Burst, 1))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.RequestsPerSecond
+	}
+	b.tokens = math.Min(b.tokens, burst)
+	b.last = now
+	b.lastSeen = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / limit.RequestsPerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.lastSeen)
+}
+
+type rateLimiter struct {
+	config  RateLimitConfig
+	buckets syncx.Map[string, *tokenBucket]
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.BucketTtl == 0 {
+		config.BucketTtl = 10 * time.Minute
+	}
+	return &rateLimiter{
+		config:  config,
+		buckets: syncx.Map[string, *tokenBucket]{},
+	}
+}
+
+func (l *rateLimiter) limitFor(tier string) RateLimit {
+	if limit, ok := l.config.Tiers[tier]; ok {
+		return limit
+	}
+	return l.config.Default
+}
+
+func (l *rateLimiter) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	if limit.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+	bucket, _ := l.buckets.LoadOrStore(key, &tokenBucket{})
+	return bucket.take(limit, now)
+}
+
+// evictIdleBuckets periodically forgets buckets nobody has used for
+// BucketTtl. A forgotten bucket would have refilled to its burst anyway.
+func (l *rateLimiter) evictIdleBuckets() {
+	ticker := time.NewTicker(l.config.BucketTtl / 2)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		l.buckets.Range(func(key string, bucket *tokenBucket) bool {
+			if bucket.idleSince(now) > l.config.BucketTtl {
+				l.buckets.CompareAndDelete(key, bucket)
+			}
+			return true
+		})
+	}
+}
+
+// RateLimitMiddleware limits requests per instance according to the owning
+// user's subscription tier, answering 429 with Retry-After once the bucket
+// is empty. Add it to ProxyConfig.PockerMiddlewares; requests for unknown
+// hosts pass through for PockerMiddleware to reject.
+func RateLimitMiddleware(config RateLimitConfig) gin.HandlerFunc {
+	limiter := newRateLimiter(config)
+	go limiter.evictIdleBuckets()
+
+	return func(c *gin.Context) {
+		deployment, err := ResolveDeployment(c)
+		if err != nil {
+			c.Next()
+			return
+		}
+
+		key := deployment.InstanceId()
+		if config.PerClientIp {
+			key = key + "|" + c.ClientIP()
+		}
+		tier := deployment.Subscription()
+
+		allowed, retryAfter := limiter.allow(key, limiter.limitFor(tier), time.Now())
+		if !allowed {
+			rateLimitedTotal.Inc(tier)
+			slog.Debug("Rate limited request",
+				"instance_id", deployment.InstanceId(),
+				"tier", tier,
+				"retry_after", retryAfter)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			abortWithError(c, http.StatusTooManyRequests, "Too many requests. Please slow down.")
+			return
+		}
+		c.Next()
+	}
+}
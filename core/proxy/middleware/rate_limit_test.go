@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{
+		Tiers:   map[string]RateLimit{"premium": {RequestsPerSecond: 10, Burst: 5}},
+		Default: RateLimit{RequestsPerSecond: 1, Burst: 2},
+	})
+	now := time.Unix(1_700_000_000, 0)
+
+	free := limiter.limitFor("free")
+	for i := range 2 {
+		if ok, _ := limiter.allow("a", free, now); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+	ok, retryAfter := limiter.allow("a", free, now)
+	if ok {
+		t.Fatal("request past burst was allowed")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("retryAfter = %s, want 1s", retryAfter)
+	}
+	if ok, _ := limiter.allow("a", free, now.Add(time.Second)); !ok {
+		t.Fatal("bucket did not refill")
+	}
+
+	// Buckets are independent and use their tier's limit
+	premium := limiter.limitFor("premium")
+	for i := range 5 {
+		if ok, _ := limiter.allow("b", premium, now); !ok {
+			t.Fatalf("premium request %d was limited", i)
+		}
+	}
+	if _, retryAfter := limiter.allow("b", premium, now); retryAfter != 100*time.Millisecond {
+		t.Fatalf("retryAfter = %s, want 100ms", retryAfter)
+	}
+
+	if ok, _ := limiter.allow("c", RateLimit{}, now); !ok {
+		t.Fatal("a zero limit should be unlimited")
+	}
+}
+
+func TestParseRateLimitTiers(t *testing.T) {
+	tiers, err := ParseRateLimitTiers(map[string]string{"free": "10/20", "premium": "2.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiers["free"] != (RateLimit{RequestsPerSecond: 10, Burst: 20}) {
+		t.Fatalf("free = %+v", tiers["free"])
+	}
+	if tiers["premium"] != (RateLimit{RequestsPerSecond: 2.5, Burst: 3}) {
+		t.Fatalf("premium = %+v", tiers["premium"])
+	}
+
+	for _, value := range []string{"", "fast", "-1", "10/0", "10/x"} {
+		if _, err := ParseRateLimit(value); err == nil {
+			t.Fatalf("expected an error for %q", value)
+		}
+	}
+}
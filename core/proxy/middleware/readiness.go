@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"pocker/core/ioc"
+)
+
+// LegacyOriginReadinessCheck dials the legacy origin this machine forwards
+// to. It is not required: a legacy outage shouldn't pull machines that can
+// still serve local and neighbor deployments out of rotation.
+func LegacyOriginReadinessCheck(config PockerMiddlewareConfig) ioc.ReadinessCheck {
+	return ioc.ReadinessCheck{
+		Name:     "legacy_origin",
+		Required: false,
+		Check: func(ctx context.Context) error {
+			targets := config.legacyOriginHelperProxyUrls()
+			if ioc.MachineInfoService().MachineId() == config.LegacyOriginHelperMachineId {
+				targets = config.legacyOriginUrls()
+			}
+
+			// Any one reachable origin is enough for the pool to serve
+			errs := []error{}
+			for _, target := range targets {
+				targetUrl, err := url.Parse(target)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("invalid legacy origin url: %w", err))
+					continue
+				}
+				dialer := net.Dialer{}
+				conn, err := dialer.DialContext(ctx, "tcp", upstreamAddress(targetUrl))
+				if err != nil {
+					errs = append(errs, fmt.Errorf("legacy origin %s unreachable: %w", targetUrl.Host, err))
+					continue
+				}
+				conn.Close()
+				return nil
+			}
+			if len(errs) == 0 {
+				return errors.New("no legacy origin configured")
+			}
+			return errors.Join(errs...)
+		},
+	}
+}
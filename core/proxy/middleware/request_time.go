@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"bufio"
 	"fmt"
+	"net"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,6 +14,7 @@ type customResponseWriter struct {
 	gin.ResponseWriter
 	start   time.Time
 	context *gin.Context
+	stamped bool
 }
 
 func NewCustomResponseWriter(c *gin.Context) *customResponseWriter {
@@ -21,13 +25,17 @@ func NewCustomResponseWriter(c *gin.Context) *customResponseWriter {
 	}
 }
 
-func (w *customResponseWriter) WriteHeader(code int) {
+// stampTiming adds the timing headers once, before the status line goes out
+func (w *customResponseWriter) stampTiming() {
+	if w.stamped || w.Written() {
+		return
+	}
+	w.stamped = true
 	elapsed := time.Since(w.start)
 	end := time.Now()
 	w.Header().Set("X-PocketHost-Request-StartTime", fmt.Sprintf("%d", w.start.UnixMilli()))
 	w.Header().Set("X-PocketHost-Request-End-Time", fmt.Sprintf("%d", end.UnixMilli()))
 	w.Header().Set("X-PocketHost-Request-Duration", fmt.Sprintf("%d", elapsed.Milliseconds()))
-	w.ResponseWriter.WriteHeader(code)
 	// slog.Debug("Request timing",
 	// 	"url", w.context.Request.URL.String(),
 	// 	"scheme", w.context.Request.URL.Scheme,
@@ -39,6 +47,45 @@ func (w *customResponseWriter) WriteHeader(code int) {
 	// 	"duration", elapsed.Milliseconds())
 }
 
+func (w *customResponseWriter) WriteHeader(code int) {
+	w.stampTiming()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// The embedded gin writer sends the header itself on these paths, so each
+// one has to stamp the timing first or streamed and upgraded responses
+// would go out without it
+
+func (w *customResponseWriter) WriteHeaderNow() {
+	w.stampTiming()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *customResponseWriter) Write(data []byte) (int, error) {
+	w.stampTiming()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *customResponseWriter) WriteString(s string) (int, error) {
+	w.stampTiming()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *customResponseWriter) Flush() {
+	w.stampTiming()
+	w.ResponseWriter.Flush()
+}
+
+func (w *customResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.stampTiming()
+	return w.ResponseWriter.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath
+func (w *customResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func RequestTimerMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		writer := NewCustomResponseWriter(c)
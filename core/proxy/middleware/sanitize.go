@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultInternalHeaders are headers only Pocker machines may set. A trailing
+// "*" matches any header with that prefix.
+var DefaultInternalHeaders = []string{
+	LegacySecretHeader,
+	"X-PocketHost-*",
+}
+
+// forwardingHeaders describe the path a request took and are only believed
+// when they come from a trusted proxy
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-Ip",
+	"Forwarded",
+}
+
+type HeaderSanitizerConfig struct {
+	// InternalHeaders are stripped from requests sent by untrusted clients.
+	// Defaults to DefaultInternalHeaders.
+	InternalHeaders []string
+	// TrustedProxies are the CIDRs, such as Fly's 6PN range fdaa::/16, whose
+	// internal and forwarding headers are passed on as is
+	TrustedProxies []string
+}
+
+type headerSanitizer struct {
+	exact    map[string]bool
+	prefixes []string
+	trusted  []netip.Prefix
+}
+
+func newHeaderSanitizer(config HeaderSanitizerConfig) (*headerSanitizer, error) {
+	internalHeaders := config.InternalHeaders
+	if internalHeaders == nil {
+		internalHeaders = DefaultInternalHeaders
+	}
+
+	sanitizer := &headerSanitizer{exact: map[string]bool{}}
+	for _, header := range internalHeaders {
+		if prefix, ok := strings.CutSuffix(header, "*"); ok {
+			sanitizer.prefixes = append(sanitizer.prefixes, http.CanonicalHeaderKey(prefix))
+			continue
+		}
+		sanitizer.exact[http.CanonicalHeaderKey(header)] = true
+	}
+
+	for _, cidr := range config.TrustedProxies {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", cidr, err)
+		}
+		sanitizer.trusted = append(sanitizer.trusted, prefix.Masked())
+	}
+	return sanitizer, nil
+}
+
+func (s *headerSanitizer) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range s.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *headerSanitizer) isInternal(header string) bool {
+	if s.exact[header] {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(header, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitize strips internal and forwarding headers sent by untrusted clients
+// and fills in X-Forwarded-Proto and X-Forwarded-Host. X-Forwarded-For is
+// left for httputil.ReverseProxy, which appends the immediate peer to
+// whatever chain survives here.
+func (s *headerSanitizer) sanitize(r *http.Request) {
+	if !s.isTrusted(r.RemoteAddr) {
+		for header := range r.Header {
+			if s.isInternal(header) {
+				r.Header.Del(header)
+			}
+		}
+		for _, header := range forwardingHeaders {
+			r.Header.Del(header)
+		}
+	}
+
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+// HeaderSanitizerMiddleware keeps untrusted clients from spoofing headers
+// that Pocker machines and upstreams rely on
+func HeaderSanitizerMiddleware(config HeaderSanitizerConfig) gin.HandlerFunc {
+	sanitizer, err := newHeaderSanitizer(config)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid header sanitizer config: %s", err))
+	}
+
+	return func(c *gin.Context) {
+		sanitizer.sanitize(c.Request)
+		c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderSanitizer(t *testing.T) {
+	sanitizer, err := newHeaderSanitizer(HeaderSanitizerConfig{
+		TrustedProxies: []string{"fdaa::/16", "10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantKept   bool
+	}{
+		{name: "public client", remoteAddr: "203.0.113.7:5000", wantKept: false},
+		{name: "6PN peer", remoteAddr: "[fdaa:0:1::3]:5000", wantKept: true},
+		{name: "mapped private peer", remoteAddr: "[::ffff:10.1.2.3]:5000", wantKept: true},
+		{name: "unparseable address", remoteAddr: "pipe", wantKept: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://app.pockethost.io/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(LegacySecretHeader, "guess")
+			req.Header.Set(ForwardedByHeader, "machine-1")
+			req.Header.Set("X-Forwarded-For", "198.51.100.1")
+			req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("Authorization", "Bearer token")
+
+			sanitizer.sanitize(req)
+
+			internal := []string{LegacySecretHeader, ForwardedByHeader, "X-Forwarded-For"}
+			for _, header := range internal {
+				if kept := req.Header.Get(header) != ""; kept != tt.wantKept {
+					t.Errorf("%s kept = %v, want %v", header, kept, tt.wantKept)
+				}
+			}
+			if req.Header.Get("Authorization") == "" {
+				t.Error("Authorization should never be stripped")
+			}
+
+			wantHost, wantProto := "app.pockethost.io", "http"
+			if tt.wantKept {
+				wantHost, wantProto = "spoofed.example.com", "https"
+			}
+			if got := req.Header.Get("X-Forwarded-Host"); got != wantHost {
+				t.Errorf("X-Forwarded-Host = %q, want %q", got, wantHost)
+			}
+			if got := req.Header.Get("X-Forwarded-Proto"); got != wantProto {
+				t.Errorf("X-Forwarded-Proto = %q, want %q", got, wantProto)
+			}
+		})
+	}
+}
+
+func TestHeaderSanitizerRejectsInvalidCidr(t *testing.T) {
+	if _, err := newHeaderSanitizer(HeaderSanitizerConfig{TrustedProxies: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Reasons an upstream request can fail, as reported in metrics
+const (
+	upstreamErrorClientCanceled = "client_canceled"
+	upstreamErrorTimeout        = "timeout"
+	upstreamErrorTLS            = "tls"
+	upstreamErrorDial           = "dial"
+	upstreamErrorOther          = "other"
+)
+
+// classifyUpstreamError maps a reverse proxy transport error to a failure
+// reason and the status code the client should see
+func classifyUpstreamError(err error) (string, int) {
+	var netErr net.Error
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return upstreamErrorClientCanceled, 499
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return upstreamErrorTimeout, http.StatusGatewayTimeout
+	case errors.As(err, &certErr),
+		errors.As(err, &recordErr),
+		errors.As(err, &alertErr),
+		errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr),
+		errors.Is(err, ErrCertificatePinMismatch):
+		return upstreamErrorTLS, http.StatusBadGateway
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return upstreamErrorDial, http.StatusBadGateway
+	}
+	return upstreamErrorOther, http.StatusBadGateway
+}
+
+// handleUpstreamError records a failed upstream request and answers the
+// client with the same error page RecoveryMiddleware uses
+func handleUpstreamError(w http.ResponseWriter, r *http.Request, err error, upstream string, message string) {
+	reason, status := classifyUpstreamError(err)
+	upstreamErrorsTotal.Inc(upstream, reason)
+
+	// Nobody is left to read a response
+	if reason == upstreamErrorClientCanceled {
+		slog.Debug("Client canceled upstream request",
+			"upstream", upstream,
+			"host", r.Host,
+			"path", r.URL.Path)
+		return
+	}
+
+	slog.Warn("Upstream request failed",
+		"upstream", upstream,
+		"reason", reason,
+		"host", r.Host,
+		"path", r.URL.Path,
+		"error", err)
+
+	if status == http.StatusGatewayTimeout {
+		message = "The upstream server took too long to respond. Please try again later."
+	}
+	writeError(w, r, status, message)
+}
+
+// upstreamErrorHandler builds a reverse proxy ErrorHandler for upstream
+func upstreamErrorHandler(upstream string, message string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		handleUpstreamError(w, r, err, upstream, message)
+	}
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+		wantStatus int
+	}{
+		{
+			name:       "client canceled",
+			err:        fmt.Errorf("proxy: %w", context.Canceled),
+			wantReason: upstreamErrorClientCanceled,
+			wantStatus: 499,
+		},
+		{
+			name:       "deadline exceeded",
+			err:        context.DeadlineExceeded,
+			wantReason: upstreamErrorTimeout,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "read timeout",
+			err:        &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded},
+			wantReason: upstreamErrorTimeout,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "unknown authority",
+			err:        fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}),
+			wantReason: upstreamErrorTLS,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "connection refused",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			wantReason: upstreamErrorDial,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "unexpected eof",
+			err:        errors.New("unexpected EOF"),
+			wantReason: upstreamErrorOther,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, status := classifyUpstreamError(tt.err)
+			if reason != tt.wantReason {
+				t.Errorf("classifyUpstreamError() reason = %s, want %s", reason, tt.wantReason)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("classifyUpstreamError() status = %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandleUpstreamError_ContentNegotiation(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		accept          string
+		wantContentType string
+	}{
+		{accept: "application/json", wantContentType: "application/json"},
+		{accept: "text/plain", wantContentType: "text/plain"},
+		{accept: "", wantContentType: "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantContentType, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/health", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+
+			handleUpstreamError(w, r, dialErr, "test", "upstream down")
+
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %s, want %s", got, tt.wantContentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Ways an upstreamPool spreads requests over its upstreams
+const (
+	BalancingRoundRobin      = "round_robin"
+	BalancingLeastConnection = "least_connections"
+)
+
+var errNoUpstream = errors.New("no upstream available")
+
+type upstream struct {
+	url     *url.URL
+	healthy atomic.Bool
+	active  atomic.Int64
+}
+
+// upstreamPool is an http.RoundTripper that balances requests over several
+// equivalent origins. Unhealthy origins are skipped, and idempotent requests
+// that fail to connect are retried on the next origin.
+type upstreamPool struct {
+	name      string
+	upstreams []*upstream
+	balancing string
+	next      atomic.Uint64
+	transport http.RoundTripper
+}
+
+func newUpstreamPool(name string, rawUrls []string, balancing string, transport http.RoundTripper) (*upstreamPool, error) {
+	if len(rawUrls) == 0 {
+		return nil, fmt.Errorf("%s: at least one url is required", name)
+	}
+	if balancing == "" {
+		balancing = BalancingRoundRobin
+	}
+	if balancing != BalancingRoundRobin && balancing != BalancingLeastConnection {
+		return nil, fmt.Errorf("%s: unknown balancing %q", name, balancing)
+	}
+
+	pool := &upstreamPool{
+		name:      name,
+		balancing: balancing,
+		transport: transport,
+	}
+	for _, rawUrl := range rawUrls {
+		parsed, err := url.Parse(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse url %s: %w", name, rawUrl, err)
+		}
+		u := &upstream{url: parsed}
+		u.healthy.Store(true)
+		pool.upstreams = append(pool.upstreams, u)
+	}
+	return pool, nil
+}
+
+// pick chooses the next upstream that hasn't been tried yet, preferring
+// healthy ones. When every upstream is unhealthy it still hands one out, so
+// a flapping health check never takes the whole pool offline.
+func (p *upstreamPool) pick(tried map[*upstream]bool) *upstream {
+	if picked := p.pickFrom(tried, true); picked != nil {
+		return picked
+	}
+	return p.pickFrom(tried, false)
+}
+
+func (p *upstreamPool) pickFrom(tried map[*upstream]bool, healthyOnly bool) *upstream {
+	start := int(p.next.Add(1) - 1)
+	var picked *upstream
+	for i := range p.upstreams {
+		candidate := p.upstreams[(start+i)%len(p.upstreams)]
+		if tried[candidate] || (healthyOnly && !candidate.healthy.Load()) {
+			continue
+		}
+		if p.balancing == BalancingRoundRobin {
+			return candidate
+		}
+		if picked == nil || candidate.active.Load() < picked.active.Load() {
+			picked = candidate
+		}
+	}
+	return picked
+}
+
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := map[*upstream]bool{}
+	var lastErr error = errNoUpstream
+	for {
+		u := p.pick(tried)
+		if u == nil {
+			return nil, lastErr
+		}
+		tried[u] = true
+
+		outReq := req.Clone(req.Context())
+		outReq.URL.Scheme = u.url.Scheme
+		outReq.URL.Host = u.url.Host
+		if u.url.Path != "" && u.url.Path != "/" {
+			joined := u.url.JoinPath(req.URL.Path)
+			outReq.URL.Path = joined.Path
+			outReq.URL.RawPath = joined.RawPath
+		}
+
+		u.active.Add(1)
+		resp, err := p.transport.RoundTrip(outReq)
+		if err == nil {
+			// Upgraded connections need the raw io.ReadWriteCloser body, so
+			// they are not tracked past the handshake
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				u.active.Add(-1)
+				return resp, nil
+			}
+			resp.Body = &trackedBody{ReadCloser: resp.Body, upstream: u}
+			return resp, nil
+		}
+		u.active.Add(-1)
+		lastErr = err
+
+		if !isConnectError(err) {
+			return nil, err
+		}
+		p.markUnhealthy(u, err)
+		if !canRetry(req) {
+			return nil, err
+		}
+		slog.Debug("Retrying request on next upstream",
+			"pool", p.name,
+			"failed", u.url.Host,
+			"error", err)
+	}
+}
+
+func (p *upstreamPool) markUnhealthy(u *upstream, err error) {
+	if u.healthy.Swap(false) {
+		slog.Warn("Upstream marked unhealthy", "pool", p.name, "url", u.url.String(), "error", err)
+	}
+}
+
+// HealthCheck dials every upstream and updates its health
+func (p *upstreamPool) HealthCheck(timeout time.Duration) {
+	for _, u := range p.upstreams {
+		conn, err := net.DialTimeout("tcp", upstreamAddress(u.url), timeout)
+		if err != nil {
+			p.markUnhealthy(u, err)
+			continue
+		}
+		conn.Close()
+		if !u.healthy.Swap(true) {
+			slog.Info("Upstream healthy again", "pool", p.name, "url", u.url.String())
+		}
+	}
+}
+
+// StartHealthChecks runs HealthCheck on an interval for the life of the
+// process
+func (p *upstreamPool) StartHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.HealthCheck(interval / 2)
+		}
+	}()
+}
+
+// newPoolProxy builds a reverse proxy whose upstream is chosen per attempt by
+// the pool. The Host header is left untouched, as with
+// httputil.NewSingleHostReverseProxy.
+func newPoolProxy(pool *upstreamPool) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport: pool,
+	}
+}
+
+// canRetry reports whether a request can safely be sent again: its method is
+// idempotent and there is no body that was already consumed
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// isConnectError reports whether the request failed before reaching the
+// upstream at all
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func upstreamAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// trackedBody keeps an upstream's connection counted as active until the
+// response has been fully relayed
+type trackedBody struct {
+	io.ReadCloser
+	upstream *upstream
+	closed   atomic.Bool
+}
+
+func (b *trackedBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.upstream.active.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
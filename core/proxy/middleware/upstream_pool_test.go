@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// closedUrl returns the url of a port nothing is listening on
+func closedUrl(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return "http://" + addr
+}
+
+func namedServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, proxy http.Handler, method string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(method, "http://app.example.com/api/health", body))
+	return rec
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	a := namedServer(t, "a")
+	b := namedServer(t, "b")
+	pool, err := newUpstreamPool("test", []string{a.URL, b.URL}, "", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newPoolProxy(pool)
+
+	seen := map[string]int{}
+	for range 4 {
+		rec := get(t, proxy, http.MethodGet, nil)
+		seen[rec.Body.String()]++
+	}
+	if seen["a /api/health"] != 2 || seen["b /api/health"] != 2 {
+		t.Fatalf("requests not balanced: %v", seen)
+	}
+}
+
+func TestUpstreamPoolFailsOverIdempotentRequests(t *testing.T) {
+	live := namedServer(t, "live")
+	pool, err := newUpstreamPool("test", []string{closedUrl(t), live.URL}, BalancingRoundRobin, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newPoolProxy(pool)
+	proxy.ErrorHandler = upstreamErrorHandler("test", "unreachable")
+
+	for range 3 {
+		rec := get(t, proxy, http.MethodGet, nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "live /api/health" {
+			t.Fatalf("got %d %q, want the live upstream", rec.Code, rec.Body.String())
+		}
+	}
+	if pool.upstreams[0].healthy.Load() {
+		t.Fatal("dead upstream should be marked unhealthy")
+	}
+}
+
+func TestUpstreamPoolDoesNotRetryRequestsWithBody(t *testing.T) {
+	live := namedServer(t, "live")
+	pool, err := newUpstreamPool("test", []string{closedUrl(t), live.URL}, BalancingRoundRobin, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := newPoolProxy(pool)
+	proxy.ErrorHandler = upstreamErrorHandler("test", "unreachable")
+
+	rec := get(t, proxy, http.MethodPost, strings.NewReader("{}"))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestUpstreamPoolJoinsBasePath(t *testing.T) {
+	server := namedServer(t, "base")
+	pool, err := newUpstreamPool("test", []string{server.URL + "/prefix"}, BalancingLeastConnection, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(t, newPoolProxy(pool), http.MethodGet, nil)
+	if got := rec.Body.String(); got != "base /prefix/api/health" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestNewUpstreamPoolRejectsUnknownBalancing(t *testing.T) {
+	if _, err := newUpstreamPool("test", []string{"http://a"}, "random", http.DefaultTransport); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := newUpstreamPool("test", nil, "", http.DefaultTransport); err == nil {
+		t.Fatal("expected an error for an empty pool")
+	}
+}
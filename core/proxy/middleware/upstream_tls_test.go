@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tlsClient(t *testing.T, config UpstreamTLSConfig) (*http.Client, error) {
+	t.Helper()
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		config  UpstreamTLSConfig
+		wantErr bool
+		wantPin bool
+	}{
+		{name: "system roots reject self-signed", config: UpstreamTLSConfig{}, wantErr: true},
+		{name: "CA file", config: UpstreamTLSConfig{CAFile: caFile}},
+		{name: "CA file with wrong server name", config: UpstreamTLSConfig{CAFile: caFile, ServerName: "origin.pockethost.invalid"}, wantErr: true},
+		{name: "pin only", config: UpstreamTLSConfig{PinnedKeys: []string{pin}}},
+		{name: "CA file and pin", config: UpstreamTLSConfig{CAFile: caFile, PinnedKeys: []string{pin}}},
+		{name: "pin mismatch", config: UpstreamTLSConfig{PinnedKeys: []string{otherPin}}, wantErr: true, wantPin: true},
+		{name: "insecure", config: UpstreamTLSConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := tlsClient(t, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(server.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantPin && !errors.Is(err, ErrCertificatePinMismatch) {
+				t.Fatalf("err = %v, want pin mismatch", err)
+			}
+			if err != nil {
+				if reason, _ := classifyUpstreamError(err); reason != upstreamErrorTLS {
+					t.Fatalf("reason = %s, want %s", reason, upstreamErrorTLS)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfigRejectsInvalidOptions(t *testing.T) {
+	configs := []UpstreamTLSConfig{
+		{InsecureSkipVerify: true, PinnedKeys: []string{"abc"}},
+		{PinnedKeys: []string{"not a hash"}},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+	}
+	for _, config := range configs {
+		if _, err := config.tlsConfig(); err == nil {
+			t.Fatalf("expected an error for %+v", config)
+		}
+	}
+}
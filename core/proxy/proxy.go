@@ -1,41 +1,109 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
 	"pocker/core/proxy/middleware"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const readinessTimeout = 2 * time.Second
+
 type Proxy struct {
 	config ProxyConfig
+	server *http.Server
+	// privateServer is nil when no private listener is configured
+	privateServer *http.Server
+	// pocker routes tenant traffic. Both listeners share it, so they share
+	// its upstream pools.
+	pocker gin.HandlerFunc
 }
 
 type ProxyConfig struct {
 	PockerMiddlewareConfig middleware.PockerMiddlewareConfig
+	HeaderSanitizerConfig  middleware.HeaderSanitizerConfig
 	ListenAddr             string
-	Middlewares            []gin.HandlerFunc
-	PockerMiddlewares      []gin.HandlerFunc
-	DevMode                bool
+	// PrivateListenAddr serves the readiness breakdown and metrics, which
+	// name instances and upstreams, away from tenant hosts, and on the legacy
+	// origin helper, forwarded legacy traffic. Bind it to a private
+	// interface. There is no default: empty leaves all of these unserved.
+	// The examples' -private-http flag defaults to fly-local-6pn:9090 on Fly
+	// and 127.0.0.1:9090 locally.
+	PrivateListenAddr string
+	Middlewares       []gin.HandlerFunc
+	PockerMiddlewares []gin.HandlerFunc
+	DevMode           bool
 }
 
+// NewProxy builds the server up front, so Shutdown never races Start over it
 func NewProxy(config ProxyConfig) *Proxy {
-	return &Proxy{
+	if !config.DevMode {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	p := &Proxy{
 		config: config,
+		pocker: middleware.PockerMiddleware(config.PockerMiddlewareConfig),
+	}
+	p.server = &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: p.handler(),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			// slog.Debug("Connection state", "state", state, "ip", conn.RemoteAddr(), "url", conn.RemoteAddr().String())
+		},
 	}
+	if config.PrivateListenAddr != "" {
+		p.privateServer = &http.Server{
+			Addr:    config.PrivateListenAddr,
+			Handler: p.privateHandler(),
+		}
+	} else {
+		slog.Warn("No private listener, /x/metrics and forwarded legacy traffic are not served")
+	}
+	return p
 }
 
-// Modify Start method to use middleware
 func (p *Proxy) Start() {
+	if p.privateServer != nil {
+		go serve(p.privateServer, "private")
+	}
+	serve(p.server, "main")
+}
 
-	if !p.config.DevMode {
-		gin.SetMode(gin.ReleaseMode)
+func serve(server *http.Server, name string) {
+	slog.Info("Starting server",
+		"server", name,
+		"addr", server.Addr)
+
+	if err := server.ListenAndServe(); err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			slog.Info("Server stopped",
+				"server", name)
+			return
+		}
+		slog.Error("Server failed to start",
+			"server", name,
+			"error", err)
+		panic(err)
 	}
+}
 
+// handler builds the router with every middleware and route bound
+func (p *Proxy) handler() http.Handler {
 	r := gin.New()
+	// ClientIP only believes forwarding headers from the same proxies the
+	// header sanitizer trusts
+	if err := r.SetTrustedProxies(p.config.HeaderSanitizerConfig.TrustedProxies); err != nil {
+		panic(fmt.Sprintf("Invalid trusted proxies: %s", err))
+	}
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		Formatter: func(param gin.LogFormatterParams) string {
 			return fmt.Sprintf("[GIN] %v | %3d | %13v | %7s | %s | %s | %s\n",
@@ -54,45 +122,111 @@ func (p *Proxy) Start() {
 	p.applyGlobalMiddlewares(r)
 	p.bindEdgeApi(r)
 	p.bindPockerDefaultHandler(r)
-	server := &http.Server{
-		Addr:    p.config.ListenAddr,
-		Handler: r,
-		ConnState: func(conn net.Conn, state http.ConnState) {
-			// slog.Debug("Connection state", "state", state, "ip", conn.RemoteAddr(), "url", conn.RemoteAddr().String())
-		},
+	return r
+}
+
+// privateHandler serves the operational endpoints that must not be reachable
+// through tenant hosts. On the legacy origin helper it also accepts the
+// signed legacy traffic other machines forward. That traffic gets a router of
+// its own so a relayed /x/metrics can't reach the helper's operational
+// endpoints.
+func (p *Proxy) privateHandler() http.Handler {
+	ops := gin.New()
+	ops.Use(gin.Recovery())
+	api := ops.Group("/x")
+	{
+		api.GET("/live", handleLive)
+		api.GET("/ready", p.handleReady(true))
+		api.GET("/metrics", gin.WrapH(metrics.Default.Handler()))
+	}
+	if ioc.MachineInfoService().MachineId() != p.config.PockerMiddlewareConfig.LegacyOriginHelperMachineId {
+		return ops
 	}
 
-	slog.Info("Starting main server",
-		"addr", p.config.ListenAddr)
+	relay := gin.New()
+	relay.Use(gin.Recovery())
+	relay.NoRoute(
+		middleware.RecoveryMiddleware(),
+		middleware.LegacyForwardAuthMiddleware(p.config.PockerMiddlewareConfig),
+		p.pocker,
+	)
+	// Unsigned requests for anything but the operational endpoints are turned
+	// away by the relay's signature check
+	ops.NoRoute(gin.WrapH(relay))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(middleware.LegacySignatureHeader) != "" {
+			relay.ServeHTTP(w, r)
+			return
+		}
+		ops.ServeHTTP(w, r)
+	})
+}
 
-	if err := server.ListenAndServe(); err != nil {
-		slog.Error("Server failed to start",
-			"error", err)
-		panic(err)
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish, giving up when ctx expires. Once shut down, Start returns right
+// away.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	err := p.server.Shutdown(ctx)
+	if p.privateServer != nil {
+		err = errors.Join(err, p.privateServer.Shutdown(ctx))
 	}
+	return err
 }
 
 func (p *Proxy) applyGlobalMiddlewares(r *gin.Engine) {
 	r.Use(middleware.RecoveryMiddleware())
+	r.Use(middleware.HeaderSanitizerMiddleware(p.config.HeaderSanitizerConfig))
 	r.Use(middleware.RequestTimerMiddleware())
 	r.Use(p.config.Middlewares...)
 }
 
+// bindEdgeApi serves what load balancers probe on every host. Metrics and
+// the readiness breakdown are only on the private listener.
 func (p *Proxy) bindEdgeApi(r *gin.Engine) {
 	api := r.Group("/x")
 	{
-		api.GET("/health", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"message": "ok"})
-		})
+		api.GET("/health", handleLive)
+		api.GET("/live", handleLive)
+		api.GET("/ready", p.handleReady(false))
+	}
+}
+
+func handleLive(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// handleReady reports 503 until every required readiness check passes. Only
+// a detailed handler says which checks failed and why.
+func (p *Proxy) handleReady(detailed bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+
+		checks := ioc.Ioc().ReadinessChecks()
+		checks = append(checks, middleware.LegacyOriginReadinessCheck(p.config.PockerMiddlewareConfig))
+		ready, results := ioc.RunReadinessChecks(ctx, checks)
+
+		status := http.StatusOK
+		message := "ready"
+		if !ready {
+			status = http.StatusServiceUnavailable
+			message = "not ready"
+		}
+		if !detailed {
+			c.JSON(status, gin.H{"message": message})
+			return
+		}
+		c.JSON(status, gin.H{"message": message, "checks": results})
 	}
 }
 
 func (p *Proxy) bindPockerDefaultHandler(r *gin.Engine) {
 	pockerMiddlewares := []gin.HandlerFunc{
 		// middleware.RequestLoggerMiddleware(),
+		middleware.LegacyAuthMiddleware(p.config.PockerMiddlewareConfig),
 	}
 	pockerMiddlewares = append(pockerMiddlewares, p.config.PockerMiddlewares...)
-	pockerMiddlewares = append(pockerMiddlewares, middleware.PockerMiddleware(p.config.PockerMiddlewareConfig))
+	pockerMiddlewares = append(pockerMiddlewares, p.pocker)
 
 	r.NoRoute(pockerMiddlewares...)
 }
@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"pocker/core/ioc"
+	"pocker/core/proxy/middleware"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ================================================
+// Fakes standing in for the services the proxy resolves through ioc
+// ================================================
+
+const (
+	testMachineId   = "self"
+	testIdleTimeout = 500 * time.Millisecond
+	heartbeats      = 10
+	heartbeatEvery  = 100 * time.Millisecond
+)
+
+type fakeMachineInfo struct{}
+
+func (fakeMachineInfo) Start()            {}
+func (fakeMachineInfo) MachineId() string { return testMachineId }
+func (fakeMachineInfo) Region() string    { return "test" }
+func (fakeMachineInfo) PrivateIp() string { return "127.0.0.1" }
+func (fakeMachineInfo) AppName() string   { return "pocker-test" }
+func (fakeMachineInfo) PrintInfo()        {}
+
+type fakeDeployment struct {
+	id         string
+	subdomain  string
+	machineId  string
+	legacy     bool
+	privateUrl *url.URL
+}
+
+func (d *fakeDeployment) IsLegacy() bool                  { return d.legacy }
+func (d *fakeDeployment) InstanceId() string              { return d.id }
+func (d *fakeDeployment) Subdomain() string               { return d.subdomain }
+func (d *fakeDeployment) MachineId() string               { return d.machineId }
+func (d *fakeDeployment) IsUserVerified() bool            { return true }
+func (d *fakeDeployment) IsUserSuspended() bool           { return false }
+func (d *fakeDeployment) IsInstanceSuspended() bool       { return false }
+func (d *fakeDeployment) IsInstancePoweredOn() bool       { return true }
+func (d *fakeDeployment) InstanceSuspendedReason() string { return "" }
+func (d *fakeDeployment) UserSuspendedReason() string     { return "" }
+func (d *fakeDeployment) PrivateUrl() *url.URL            { return d.privateUrl }
+func (d *fakeDeployment) IdleTtl() time.Duration          { return 0 }
+func (d *fakeDeployment) Subscription() string            { return "free" }
+func (d *fakeDeployment) Version() string                 { return "" }
+func (d *fakeDeployment) Secrets() map[string]string      { return nil }
+
+type fakeMothership struct {
+	deployments map[string]*fakeDeployment
+}
+
+func (m *fakeMothership) Start() {}
+
+func (m *fakeMothership) GetDeploymentByIdentifier(identifier string) (ioc.IDeployment, error) {
+	subdomain := strings.Split(identifier, ".")[0]
+	deployment, ok := m.deployments[subdomain]
+	if !ok {
+		return nil, ioc.ErrDeploymentNotFound
+	}
+	return deployment, nil
+}
+
+func (m *fakeMothership) GetDeploymentByInstanceId(instanceId string) (ioc.IDeployment, error) {
+	deployment, ok := m.deployments[instanceId]
+	if !ok {
+		return nil, ioc.ErrDeploymentNotFound
+	}
+	return deployment, nil
+}
+
+func (m *fakeMothership) OnInstanceChange(fn func(action string, instanceId string)) {}
+
+func (m *fakeMothership) OnUserChange(fn func(action string, userId string)) {}
+
+func (m *fakeMothership) GetInstanceById(id string) (ioc.IInstance, error) {
+	return nil, ioc.ErrDeploymentNotFound
+}
+
+func (m *fakeMothership) GetInstanceBySubdomain(subdomain string) (ioc.IInstance, error) {
+	return nil, ioc.ErrDeploymentNotFound
+}
+
+func (m *fakeMothership) GetInstanceByCname(cname string) (ioc.IInstance, error) {
+	return nil, ioc.ErrDeploymentNotFound
+}
+
+func (m *fakeMothership) GetInstancesByUserId(userId string) []ioc.IInstance {
+	return nil
+}
+
+func (m *fakeMothership) GetUserById(id string) (ioc.IUser, error) {
+	return nil, ioc.ErrDeploymentNotFound
+}
+
+func (m *fakeMothership) GetMachineByUuid(uuid string) (ioc.IMachine, error) {
+	return nil, ioc.ErrDeploymentNotFound
+}
+
+type fakeContainer struct {
+	url        *url.URL
+	deployment ioc.IDeployment
+}
+
+func (c *fakeContainer) Url() *url.URL               { return c.url }
+func (c *fakeContainer) Deployment() ioc.IDeployment { return c.deployment }
+func (c *fakeContainer) Release()                    {}
+func (c *fakeContainer) Status() ioc.ContainerStatus {
+	return ioc.ContainerStatus{Running: true}
+}
+
+type fakeContainerService struct {
+	url *url.URL
+}
+
+func (s *fakeContainerService) Start() {}
+
+func (s *fakeContainerService) GetOrCreateContainer(deployment ioc.IDeployment) (ioc.IContainer, error) {
+	return &fakeContainer{url: s.url, deployment: deployment}, nil
+}
+
+func (s *fakeContainerService) GetContainer(instanceId string) (ioc.IContainer, bool) {
+	return nil, false
+}
+
+func (s *fakeContainerService) StopContainer(instanceId string) bool { return false }
+
+func (s *fakeContainerService) ContainerIds() []string { return nil }
+
+// ================================================
+// Stand-in PocketBase
+// ================================================
+
+// newStandInPocketBase serves the two kinds of long-lived responses
+// PocketBase and pb_hooks produce: a realtime SSE stream and an upgraded
+// connection that echoes lines back. Both send heartbeats for a while and
+// then go quiet.
+func newStandInPocketBase() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/realtime", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprint(w, "event: PB_CONNECT\ndata: {}\n\n")
+		w.(http.Flusher).Flush()
+
+		for i := range heartbeats {
+			select {
+			case <-time.After(heartbeatEvery):
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprintf(w, "event: heartbeat\ndata: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})
+	// Only answers requests that reached it through the legacy helper
+	mux.HandleFunc("/api/legacy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(middleware.LegacySecretHeader) != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	mux.HandleFunc("/api/host", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+var (
+	standIn *httptest.Server
+	edge    *httptest.Server
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	standIn = newStandInPocketBase()
+	standInUrl, _ := url.Parse(standIn.URL)
+
+	ioc.RegisterMachineInfoService(fakeMachineInfo{})
+	ioc.RegisterContainerService(&fakeContainerService{url: standInUrl})
+	ioc.RegisterMothershipService(&fakeMothership{
+		deployments: map[string]*fakeDeployment{
+			"legacy":   {id: "legacy", subdomain: "legacy", legacy: true},
+			"local":    {id: "local", subdomain: "local", machineId: testMachineId},
+			"neighbor": {id: "neighbor", subdomain: "neighbor", machineId: "other", privateUrl: standInUrl},
+			// Found by its cname, api.customer.test
+			"api": {id: "cnamed", subdomain: "cnamed", legacy: true},
+		},
+	})
+
+	proxy := NewProxy(ProxyConfig{
+		PockerMiddlewareConfig: middleware.PockerMiddlewareConfig{
+			// This machine is the legacy helper, so legacy requests go
+			// straight to the origin
+			LegacyOriginUrl:             standIn.URL,
+			LegacyOriginHelperProxyUrl:  standIn.URL,
+			LegacyOriginHelperMachineId: testMachineId,
+			LegacyApexDomain:            "legacy.test",
+			PHSecret:                    "secret",
+			LegacyIdleTimeout:           testIdleTimeout,
+			LocalIdleTimeout:            testIdleTimeout,
+			NeighborIdleTimeout:         testIdleTimeout,
+		},
+	})
+	edge = httptest.NewServer(proxy.handler())
+
+	code := m.Run()
+	edge.Close()
+	standIn.Close()
+	os.Exit(code)
+}
+
+var routes = []string{"legacy", "local", "neighbor"}
+
+func TestProxyStreamsServerSentEvents(t *testing.T) {
+	for _, route := range routes {
+		t.Run(route, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, edge.URL+"/api/realtime", nil)
+			req.Host = route + ".pockethost.test"
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if resp.Header.Get("X-PocketHost-Request-Duration") == "" {
+				t.Error("streamed response is missing timing headers")
+			}
+
+			// The connect event must arrive while the stream is still open
+			reader := bufio.NewReader(resp.Body)
+			line, err := reader.ReadString('\n')
+			if err != nil || line != "event: PB_CONNECT\n" {
+				t.Fatalf("first line = %q, %v", line, err)
+			}
+			if elapsed := time.Since(start); elapsed > heartbeatEvery {
+				t.Fatalf("first event took %s, it was not flushed", elapsed)
+			}
+
+			// Heartbeats keep the stream busy past the idle timeout, after
+			// which the quiet stream is closed
+			rest, err := io.ReadAll(reader)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("stream ended with %v", err)
+			}
+			if got := strings.Count(string(rest), "event: heartbeat"); got != heartbeats {
+				t.Fatalf("got %d heartbeats, want %d", got, heartbeats)
+			}
+			if elapsed := time.Since(start); elapsed > heartbeats*heartbeatEvery+4*testIdleTimeout {
+				t.Fatalf("idle stream stayed open for %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxyUpgradesWebSockets(t *testing.T) {
+	for _, route := range routes {
+		t.Run(route, func(t *testing.T) {
+			t.Parallel()
+			conn, err := net.Dial("tcp", edge.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s.pockethost.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", route)
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+
+			// Traffic spaced below the idle timeout keeps the connection up
+			// well past it
+			for i := range heartbeats {
+				message := fmt.Sprintf("message %d\n", i)
+				fmt.Fprint(conn, message)
+				echo, err := reader.ReadString('\n')
+				if err != nil || echo != message {
+					t.Fatalf("echo = %q, %v", echo, err)
+				}
+				time.Sleep(heartbeatEvery)
+			}
+
+			quietSince := time.Now()
+			if _, err := reader.ReadString('\n'); err == nil {
+				t.Fatal("expected the idle connection to be closed")
+			}
+			if elapsed := time.Since(quietSince); elapsed > 4*testIdleTimeout {
+				t.Fatalf("idle connection stayed open for %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxyRateLimitsInstances(t *testing.T) {
+	proxy := NewProxy(ProxyConfig{
+		PockerMiddlewares: []gin.HandlerFunc{
+			middleware.RateLimitMiddleware(middleware.RateLimitConfig{
+				Tiers: map[string]middleware.RateLimit{"free": {RequestsPerSecond: 0.1, Burst: 1}},
+			}),
+		},
+		PockerMiddlewareConfig: middleware.PockerMiddlewareConfig{
+			LegacyOriginUrl:             standIn.URL,
+			LegacyOriginHelperProxyUrl:  standIn.URL,
+			LegacyOriginHelperMachineId: testMachineId,
+			LegacyApexDomain:            "legacy.test",
+			PHSecret:                    "secret",
+		},
+	})
+	handler := proxy.handler()
+
+	serve := func(host string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/api/health", nil)
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("local.pockethost.test"); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("first request was limited")
+	}
+	rec := serve("local.pockethost.test")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("Retry-After = %q, want 10", rec.Header().Get("Retry-After"))
+	}
+
+	// Other instances have their own bucket
+	if rec := serve("neighbor.pockethost.test"); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("another instance was limited")
+	}
+}
+
+func TestOperationalEndpointsStayOffTenantHosts(t *testing.T) {
+	proxy := NewProxy(ProxyConfig{
+		PrivateListenAddr: "127.0.0.1:0",
+		PockerMiddlewareConfig: middleware.PockerMiddlewareConfig{
+			LegacyOriginUrl:             standIn.URL,
+			LegacyOriginHelperProxyUrl:  standIn.URL,
+			LegacyOriginHelperMachineId: testMachineId,
+			LegacyApexDomain:            "legacy.test",
+			PHSecret:                    "secret",
+		},
+	})
+
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://unknown.pockethost.test"+path, nil))
+		return rec
+	}
+
+	public := proxy.handler()
+	if rec := get(public, "/x/metrics"); strings.Contains(rec.Body.String(), "# TYPE") {
+		t.Error("metrics served on a tenant host")
+	}
+	if rec := get(public, "/x/ready"); strings.Contains(rec.Body.String(), "checks") {
+		t.Errorf("readiness breakdown served on a tenant host: %s", rec.Body.String())
+	}
+
+	private := proxy.privateServer.Handler
+	if rec := get(private, "/x/metrics"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE") {
+		t.Errorf("private /x/metrics = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get(private, "/x/ready"); !strings.Contains(rec.Body.String(), "checks") {
+		t.Errorf("private /x/ready has no breakdown: %s", rec.Body.String())
+	}
+}
+
+func TestLegacyHelperOnlyAcceptsSignedForwards(t *testing.T) {
+	legacyConfig := func(helperMachineId string, helperUrl string) middleware.PockerMiddlewareConfig {
+		return middleware.PockerMiddlewareConfig{
+			LegacyOriginUrl:             standIn.URL,
+			LegacyOriginHelperProxyUrl:  helperUrl,
+			LegacyOriginHelperMachineId: helperMachineId,
+			LegacyApexDomain:            "legacy.test",
+			PHSecret:                    "secret",
+		}
+	}
+
+	// This machine plays the helper on its private listener...
+	helper := NewProxy(ProxyConfig{
+		PrivateListenAddr:      "127.0.0.1:0",
+		PockerMiddlewareConfig: legacyConfig(testMachineId, standIn.URL),
+	})
+	helperPrivate := httptest.NewServer(helper.privateServer.Handler)
+	defer helperPrivate.Close()
+
+	// ...and, configured with another helper, the machine forwarding to it
+	forwarder := NewProxy(ProxyConfig{
+		PockerMiddlewareConfig: legacyConfig("helper", helperPrivate.URL),
+	})
+	forwarderPublic := httptest.NewServer(forwarder.handler())
+	defer forwarderPublic.Close()
+
+	get := func(base string, path string, signature string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		req.Host = "legacy.pockethost.test"
+		if signature != "" {
+			req.Header.Set(middleware.LegacySignatureHeader, signature)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := get(helperPrivate.URL, "/api/legacy", ""); status != http.StatusUnauthorized {
+		t.Errorf("unsigned forward: status = %d, want 401", status)
+	}
+	if status, _ := get(helperPrivate.URL, "/api/legacy", "t=1,m=forger,s=00"); status != http.StatusUnauthorized {
+		t.Errorf("forged forward: status = %d, want 401", status)
+	}
+	if status, _ := get(forwarderPublic.URL, "/api/legacy", ""); status != http.StatusOK {
+		t.Errorf("signed forward: status = %d, want 200", status)
+	}
+	// Relayed traffic never reaches the helper's own operational endpoints
+	if _, body := get(forwarderPublic.URL, "/x/metrics", ""); strings.Contains(body, "# TYPE") {
+		t.Error("relayed /x/metrics served the helper's metrics")
+	}
+}
+
+func TestLegacyHostUsesInstanceSubdomain(t *testing.T) {
+	for host, want := range map[string]string{
+		"legacy.pockethost.test": "legacy.legacy.test",
+		"api.customer.test":      "cnamed.legacy.test",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, edge.URL+"/api/host", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: legacy origin saw host %q, want %q", host, body, want)
+		}
+	}
+}
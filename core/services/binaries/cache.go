@@ -0,0 +1,381 @@
+package binaries
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidVersion = errors.New("invalid pocketbase version")
+
+// ErrChecksumMismatch is returned when a downloaded archive can't be matched
+// to a known SHA-256 digest. Nothing is written to the cache.
+var ErrChecksumMismatch = errors.New("pocketbase archive checksum mismatch")
+
+// versionPattern accepts release versions with an optional "v" prefix and
+// pre-release suffix. Anything else could escape the cache directory.
+var versionPattern = regexp.MustCompile(`^v?(\d+\.\d+\.\d+(?:-[0-9A-Za-z.]+)?)$`)
+
+// maxBinarySize caps how much is extracted from a release archive
+const maxBinarySize = 512 << 20
+
+// maxArchiveSize caps how much of a release archive is downloaded
+const maxArchiveSize = 512 << 20
+
+// maxChecksumsSize caps how much of a release's checksums.txt is read
+const maxChecksumsSize = 1 << 20
+
+// checksumsFile lists the SHA-256 of every asset in a release, one
+// "<digest>  <file>" per line
+const checksumsFile = "checksums.txt"
+
+// Results of a mirror download, as reported in metrics
+const (
+	resultOk      = "ok"
+	resultMissing = "missing"
+	resultError   = "error"
+)
+
+var downloadsTotal = metrics.NewCounterVec("pocker_binary_downloads_total",
+	"PocketBase binaries fetched from the mirror, by result.",
+	"result")
+
+type BinaryCacheConfig struct {
+	// Dir holds one directory per version with the executable inside, e.g.
+	// <Dir>/0.23.4/pocketbase. Binaries put there by hand are used as is.
+	Dir string
+	// MirrorUrl is where versions missing from Dir are downloaded from. It
+	// is laid out like PocketBase's GitHub releases:
+	// <MirrorUrl>/v<version>/pocketbase_<version>_<os>_<arch>.zip. Empty
+	// means Dir is all there is.
+	MirrorUrl string
+	// Digests pins the hex SHA-256 of the release archive for some versions.
+	// Other versions are checked against the checksums.txt published next to
+	// the archive. A download that can't be verified is thrown away.
+	Digests map[string]string
+	// DownloadTimeout bounds a single download. Defaults to 5m.
+	DownloadTimeout time.Duration
+	// MissingTtl is how long a version the mirror doesn't have is remembered,
+	// so instances asking for it don't hit the mirror on every request.
+	// Defaults to 1m.
+	MissingTtl time.Duration
+}
+
+// BinaryCache keeps PocketBase executables on disk by version, downloading
+// each one from the mirror the first time an instance asks for it
+type BinaryCache struct {
+	config BinaryCacheConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	fetches map[string]*fetch
+	missing map[string]time.Time
+}
+
+// fetch is a download in progress. Callers asking for the same version wait
+// on it instead of downloading again.
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+func New(config BinaryCacheConfig) *BinaryCache {
+	if config.Dir == "" {
+		panic("binary cache needs a directory")
+	}
+	if config.DownloadTimeout == 0 {
+		config.DownloadTimeout = 5 * time.Minute
+	}
+	if config.MissingTtl == 0 {
+		config.MissingTtl = time.Minute
+	}
+	digests := map[string]string{}
+	for version, digest := range config.Digests {
+		normalized, err := normalizeVersion(version)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+			panic(fmt.Sprintf("invalid sha256 digest for pocketbase %s: %q", version, digest))
+		}
+		digests[normalized] = strings.ToLower(digest)
+	}
+	config.Digests = digests
+
+	cache := BinaryCache{
+		config:  config,
+		client:  &http.Client{Timeout: config.DownloadTimeout},
+		fetches: map[string]*fetch{},
+		missing: map[string]time.Time{},
+	}
+
+	return &cache
+}
+
+// Resolve returns the path of the executable for version. Errors for
+// versions that are invalid or can't be found wrap ioc.ErrVersionUnavailable.
+func (bc *BinaryCache) Resolve(version string) (string, error) {
+	version, err := normalizeVersion(version)
+	if err != nil {
+		return "", err
+	}
+
+	path := bc.binaryPath(version)
+	if isExecutable(path) {
+		return path, nil
+	}
+	if bc.config.MirrorUrl == "" {
+		return "", fmt.Errorf("%w: %s is not in %s", ioc.ErrVersionUnavailable, version, bc.config.Dir)
+	}
+	if err := bc.fetch(version); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func normalizeVersion(version string) (string, error) {
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return "", fmt.Errorf("%w: %w %q", ioc.ErrVersionUnavailable, ErrInvalidVersion, version)
+	}
+	return match[1], nil
+}
+
+func (bc *BinaryCache) binaryPath(version string) string {
+	return filepath.Join(bc.config.Dir, version, binaryName())
+}
+
+func binaryName() string {
+	if runtime.GOOS == "windows" {
+		return "pocketbase.exe"
+	}
+	return "pocketbase"
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode()&0111 != 0
+}
+
+// fetch downloads a version once, however many callers ask for it at the
+// same time. Failures aren't kept, except that a version the mirror doesn't
+// have is remembered for MissingTtl.
+func (bc *BinaryCache) fetch(version string) error {
+	bc.mu.Lock()
+	if until, ok := bc.missing[version]; ok {
+		if time.Now().Before(until) {
+			bc.mu.Unlock()
+			return fmt.Errorf("%w: %s is not on the mirror", ioc.ErrVersionUnavailable, version)
+		}
+		delete(bc.missing, version)
+	}
+	if f, ok := bc.fetches[version]; ok {
+		bc.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &fetch{done: make(chan struct{})}
+	bc.fetches[version] = f
+	bc.mu.Unlock()
+
+	f.err = bc.download(version)
+
+	bc.mu.Lock()
+	delete(bc.fetches, version)
+	if errors.Is(f.err, ioc.ErrVersionUnavailable) {
+		bc.missing[version] = time.Now().Add(bc.config.MissingTtl)
+	}
+	bc.mu.Unlock()
+	close(f.done)
+
+	return f.err
+}
+
+func archiveName(version string) string {
+	return fmt.Sprintf("pocketbase_%s_%s_%s.zip", version, runtime.GOOS, runtime.GOARCH)
+}
+
+func (bc *BinaryCache) download(version string) error {
+	archiveUrl, err := url.JoinPath(bc.config.MirrorUrl, "v"+version, archiveName(version))
+	if err != nil {
+		return fmt.Errorf("invalid mirror url: %w", err)
+	}
+
+	slog.Info("Downloading PocketBase",
+		"version", version,
+		"url", archiveUrl)
+
+	err = bc.downloadArchive(version, archiveUrl)
+	switch {
+	case err == nil:
+		downloadsTotal.Inc(resultOk)
+	case errors.Is(err, ioc.ErrVersionUnavailable):
+		downloadsTotal.Inc(resultMissing)
+	default:
+		downloadsTotal.Inc(resultError)
+		slog.Error("Failed to download PocketBase",
+			"version", version,
+			"url", archiveUrl,
+			"error", err)
+	}
+	return err
+}
+
+func (bc *BinaryCache) downloadArchive(version string, archiveUrl string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bc.config.DownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", archiveUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s is not on the mirror", ioc.ErrVersionUnavailable, version)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mirror returned %s for %s", resp.Status, archiveUrl)
+	}
+
+	versionDir := filepath.Join(bc.config.Dir, version)
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", versionDir, err)
+	}
+
+	// zip needs random access, so the archive goes to disk first
+	archive, err := os.CreateTemp(versionDir, ".download-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(archive, hash), io.LimitReader(resp.Body, maxArchiveSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", archiveUrl, err)
+	}
+	if size > maxArchiveSize {
+		return fmt.Errorf("%s is larger than %d bytes", archiveUrl, maxArchiveSize)
+	}
+
+	want, err := bc.expectedDigest(ctx, version)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("%w: %s has sha256 %s, want %s", ErrChecksumMismatch, archiveName(version), got, want)
+	}
+
+	return extractBinary(archive, size, bc.binaryPath(version))
+}
+
+// expectedDigest returns the SHA-256 a version's archive must have, from
+// Digests or else from the release's checksums.txt
+func (bc *BinaryCache) expectedDigest(ctx context.Context, version string) (string, error) {
+	if digest, ok := bc.config.Digests[version]; ok {
+		return digest, nil
+	}
+
+	checksumsUrl, err := url.JoinPath(bc.config.MirrorUrl, "v"+version, checksumsFile)
+	if err != nil {
+		return "", fmt.Errorf("invalid mirror url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checksumsUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := bc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", checksumsUrl, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: mirror returned %s for %s", ErrChecksumMismatch, resp.Status, checksumsUrl)
+	}
+
+	name := archiveName(version)
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxChecksumsSize))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", checksumsUrl, err)
+	}
+	return "", fmt.Errorf("%w: %s is not listed in %s", ErrChecksumMismatch, name, checksumsUrl)
+}
+
+// extractBinary copies the executable out of a release archive. It is
+// written under a temporary name and renamed into place, so a partial file
+// is never mistaken for a cached binary.
+func extractBinary(archive io.ReaderAt, size int64, path string) error {
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return fmt.Errorf("invalid release archive: %w", err)
+	}
+
+	name := filepath.Base(path)
+	for _, file := range reader.File {
+		if file.Name != name {
+			continue
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("invalid release archive: %w", err)
+		}
+		defer src.Close()
+
+		dst, err := os.CreateTemp(filepath.Dir(path), ".extract-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(dst.Name())
+
+		written, err := io.Copy(dst, io.LimitReader(src, maxBinarySize+1))
+		if err == nil && written > maxBinarySize {
+			err = fmt.Errorf("%s is larger than %d bytes", name, maxBinarySize)
+		}
+		if err == nil {
+			err = dst.Chmod(0755)
+		}
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		return os.Rename(dst.Name(), path)
+	}
+
+	return fmt.Errorf("release archive has no %s", name)
+}
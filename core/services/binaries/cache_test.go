@@ -0,0 +1,216 @@
+package binaries
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pocker/core/ioc"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeMirror serves release archives and their checksums.txt laid out like
+// PocketBase's GitHub releases, for the versions it is given. Only archive
+// requests are counted.
+type fakeMirror struct {
+	*httptest.Server
+	requests atomic.Int32
+	files    map[string][]byte
+}
+
+func newFakeMirror(t *testing.T, versions ...string) *fakeMirror {
+	t.Helper()
+	mirror := &fakeMirror{files: map[string][]byte{}}
+	for _, version := range versions {
+		archive := releaseArchive(t, "fake pocketbase "+version)
+		mirror.files[fmt.Sprintf("/v%s/%s", version, archiveName(version))] = archive
+		mirror.files[fmt.Sprintf("/v%s/%s", version, checksumsFile)] = []byte(fmt.Sprintf(
+			"%s  pocketbase_%s_plan9_amd64.zip\n%s  %s\n",
+			sha256Hex([]byte("other")), version, sha256Hex(archive), archiveName(version)))
+	}
+
+	mirror.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filepath.Base(r.URL.Path) != checksumsFile {
+			mirror.requests.Add(1)
+		}
+		file, ok := mirror.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(file)
+	}))
+	t.Cleanup(mirror.Close)
+	return mirror
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func releaseArchive(t *testing.T, contents string) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	writer := zip.NewWriter(&buf)
+	for _, name := range []string{"CHANGELOG.md", binaryName()} {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(contents))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResolveUsesLocalBinary(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "0.22.1", binaryName())
+	os.MkdirAll(filepath.Dir(local), 0755)
+	os.WriteFile(local, []byte("local"), 0755)
+	mirror := newFakeMirror(t)
+
+	cache := New(BinaryCacheConfig{Dir: dir, MirrorUrl: mirror.URL})
+	path, err := cache.Resolve("v0.22.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != local {
+		t.Errorf("Resolve() = %s, want %s", path, local)
+	}
+	if mirror.requests.Load() != 0 {
+		t.Errorf("mirror hit %d times for a local binary", mirror.requests.Load())
+	}
+}
+
+func TestResolveDownloadsFromMirrorOnce(t *testing.T) {
+	mirror := newFakeMirror(t, "0.23.4")
+	cache := New(BinaryCacheConfig{Dir: t.TempDir(), MirrorUrl: mirror.URL})
+
+	paths := make([]string, 5)
+	wg := sync.WaitGroup{}
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := cache.Resolve("0.23.4")
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = path
+		}()
+	}
+	wg.Wait()
+
+	if mirror.requests.Load() != 1 {
+		t.Errorf("mirror hit %d times, want 1", mirror.requests.Load())
+	}
+	contents, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "fake pocketbase 0.23.4" {
+		t.Errorf("binary = %q", contents)
+	}
+	if !isExecutable(paths[0]) {
+		t.Error("downloaded binary isn't executable")
+	}
+
+	if _, err := cache.Resolve("0.23.4"); err != nil {
+		t.Fatal(err)
+	}
+	if mirror.requests.Load() != 1 {
+		t.Errorf("mirror hit again for a cached version")
+	}
+}
+
+func TestResolveMissingVersion(t *testing.T) {
+	mirror := newFakeMirror(t, "0.23.4")
+	cache := New(BinaryCacheConfig{Dir: t.TempDir(), MirrorUrl: mirror.URL})
+
+	for range 2 {
+		_, err := cache.Resolve("0.99.0")
+		if !errors.Is(err, ioc.ErrVersionUnavailable) {
+			t.Fatalf("Resolve() error = %v, want ErrVersionUnavailable", err)
+		}
+	}
+	if mirror.requests.Load() != 1 {
+		t.Errorf("mirror hit %d times for a missing version, want 1", mirror.requests.Load())
+	}
+}
+
+func TestResolveWithoutMirror(t *testing.T) {
+	cache := New(BinaryCacheConfig{Dir: t.TempDir()})
+	if _, err := cache.Resolve("0.23.4"); !errors.Is(err, ioc.ErrVersionUnavailable) {
+		t.Errorf("Resolve() error = %v, want ErrVersionUnavailable", err)
+	}
+}
+
+func TestResolveRejectsInvalidVersions(t *testing.T) {
+	cache := New(BinaryCacheConfig{Dir: t.TempDir()})
+	for _, version := range []string{"", "latest", "0.23", "0.23.*", "../0.23.4", "0.23.4/../../etc"} {
+		_, err := cache.Resolve(version)
+		if !errors.Is(err, ErrInvalidVersion) || !errors.Is(err, ioc.ErrVersionUnavailable) {
+			t.Errorf("Resolve(%q) error = %v, want ErrInvalidVersion", version, err)
+		}
+	}
+}
+
+func TestResolveRejectsTamperedArchive(t *testing.T) {
+	mirror := newFakeMirror(t, "0.23.4")
+	mirror.files["/v0.23.4/"+archiveName("0.23.4")] = releaseArchive(t, "tampered")
+	dir := t.TempDir()
+	cache := New(BinaryCacheConfig{Dir: dir, MirrorUrl: mirror.URL})
+
+	if _, err := cache.Resolve("0.23.4"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Resolve() error = %v, want ErrChecksumMismatch", err)
+	}
+	if isExecutable(filepath.Join(dir, "0.23.4", binaryName())) {
+		t.Error("tampered binary was cached")
+	}
+}
+
+func TestResolveRequiresPublishedChecksum(t *testing.T) {
+	mirror := newFakeMirror(t, "0.23.4")
+	delete(mirror.files, "/v0.23.4/"+checksumsFile)
+	cache := New(BinaryCacheConfig{Dir: t.TempDir(), MirrorUrl: mirror.URL})
+
+	if _, err := cache.Resolve("0.23.4"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Resolve() error = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestResolveUsesConfiguredDigest(t *testing.T) {
+	mirror := newFakeMirror(t, "0.23.4")
+	archive := mirror.files["/v0.23.4/"+archiveName("0.23.4")]
+	delete(mirror.files, "/v0.23.4/"+checksumsFile)
+
+	cache := New(BinaryCacheConfig{
+		Dir:       t.TempDir(),
+		MirrorUrl: mirror.URL,
+		Digests:   map[string]string{"v0.23.4": sha256Hex(archive)},
+	})
+	if _, err := cache.Resolve("0.23.4"); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := New(BinaryCacheConfig{
+		Dir:       t.TempDir(),
+		MirrorUrl: mirror.URL,
+		Digests:   map[string]string{"0.23.4": sha256Hex([]byte("something else"))},
+	})
+	if _, err := pinned.Resolve("0.23.4"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Resolve() error = %v, want ErrChecksumMismatch", err)
+	}
+}
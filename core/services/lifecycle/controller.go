@@ -0,0 +1,242 @@
+// Package lifecycle keeps local containers in step with their instance
+// records: it stops containers whose instance was powered off, suspended,
+// deleted or moved, and restarts them when their version or secrets change.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"pocker/core/ioc"
+	"pocker/core/metrics"
+	"sync"
+	"time"
+)
+
+var _ ioc.IService = (*LifecycleController)(nil)
+var _ ioc.IGracefulService = (*LifecycleController)(nil)
+
+// Actions the controller takes on a container, as reported in metrics
+const (
+	actionStop    = "stop"
+	actionRestart = "restart"
+)
+
+const queueSize = 1024
+
+var actionsTotal = metrics.NewCounterVec("pocker_lifecycle_actions_total",
+	"Containers stopped or restarted by the lifecycle controller, by action and reason.",
+	"action", "reason")
+
+type LifecycleControllerConfig struct {
+	// ReconcileInterval is how often every local container is checked
+	// against the mirror, catching changes made while the stream was down.
+	// Defaults to 1m.
+	ReconcileInterval time.Duration
+}
+
+type LifecycleController struct {
+	initOnce sync.Once
+	stopOnce sync.Once
+	config   LifecycleControllerConfig
+	queue    chan string
+	stopped  chan struct{}
+	done     chan struct{}
+	// actions tracks containers being stopped or restarted
+	actions sync.WaitGroup
+
+	busyMu sync.Mutex
+	// busy holds the instances with an action in flight, set to true when
+	// another change arrives for one meanwhile
+	busy map[string]bool
+}
+
+func New(config LifecycleControllerConfig) *LifecycleController {
+	if config.ReconcileInterval == 0 {
+		config.ReconcileInterval = time.Minute
+	}
+	return &LifecycleController{
+		config:  config,
+		queue:   make(chan string, queueSize),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+		busy:    map[string]bool{},
+	}
+}
+
+// Start subscribes to instance and user changes. The mothership and
+// container services must already be registered.
+func (p *LifecycleController) Start() {
+	p.initOnce.Do(func() {
+		mothership := ioc.MothershipService()
+		mothership.OnInstanceChange(p.enqueue)
+		mothership.OnUserChange(p.enqueueUser)
+		go p.run()
+	})
+}
+
+// Shutdown stops reconciling and waits for containers being stopped or
+// restarted, giving up when ctx expires
+func (p *LifecycleController) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+	done := make(chan struct{})
+	go func() {
+		<-p.done
+		p.actions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue is called on the mirroring goroutine, so it never blocks. A change
+// dropped on overflow is picked up by the next periodic reconcile.
+func (p *LifecycleController) enqueue(action string, instanceId string) {
+	select {
+	case p.queue <- instanceId:
+	default:
+		slog.Warn("Lifecycle queue full, deferring to next reconcile",
+			"instance_id", instanceId,
+			"action", action)
+	}
+}
+
+// enqueueUser queues every instance a user owns, so suspending a user stops
+// their containers without waiting for the periodic reconcile
+func (p *LifecycleController) enqueueUser(action string, userId string) {
+	for _, instance := range ioc.MothershipService().GetInstancesByUserId(userId) {
+		p.enqueue(action, instance.GetFieldMap()["id"])
+	}
+}
+
+func (p *LifecycleController) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case instanceId := <-p.queue:
+			p.reconcile(instanceId)
+		case <-ticker.C:
+			for _, instanceId := range ioc.ContainerService().ContainerIds() {
+				p.reconcile(instanceId)
+			}
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// reconcile compares an instance's local container, if it has one, with the
+// instance's current record
+func (p *LifecycleController) reconcile(instanceId string) {
+	p.busyMu.Lock()
+	if _, ok := p.busy[instanceId]; ok {
+		// Checked again once the action in flight is done
+		p.busy[instanceId] = true
+		p.busyMu.Unlock()
+		return
+	}
+	p.busyMu.Unlock()
+
+	containers := ioc.ContainerService()
+	container, ok := containers.GetContainer(instanceId)
+	if !ok {
+		return
+	}
+
+	deployment, err := ioc.MothershipService().GetDeploymentByInstanceId(instanceId)
+	if errors.Is(err, ioc.ErrDeploymentNotFound) {
+		p.stop(instanceId, "deleted")
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to resolve deployment for lifecycle check",
+			"instance_id", instanceId,
+			"error", err)
+		return
+	}
+
+	switch {
+	case deployment.MachineId() != ioc.MachineInfoService().MachineId():
+		p.stop(instanceId, "moved")
+	case !deployment.IsInstancePoweredOn():
+		p.stop(instanceId, "powered_off")
+	case deployment.IsInstanceSuspended():
+		p.stop(instanceId, "instance_suspended")
+	case deployment.IsUserSuspended():
+		p.stop(instanceId, "user_suspended")
+	case container.Deployment().Version() != deployment.Version():
+		p.restart(deployment, "version_changed")
+	case !maps.Equal(container.Deployment().Secrets(), deployment.Secrets()):
+		p.restart(deployment, "secrets_changed")
+	}
+}
+
+// act runs fn on its own goroutine, so a slow stop or launch doesn't hold up
+// other instances' changes. A change to the instance that arrives meanwhile
+// is reconciled once fn is done.
+func (p *LifecycleController) act(instanceId string, fn func()) {
+	p.busyMu.Lock()
+	p.busy[instanceId] = false
+	p.busyMu.Unlock()
+
+	p.actions.Add(1)
+	go func() {
+		defer p.actions.Done()
+		fn()
+
+		p.busyMu.Lock()
+		changed := p.busy[instanceId]
+		delete(p.busy, instanceId)
+		p.busyMu.Unlock()
+		if changed {
+			p.enqueue("retry", instanceId)
+		}
+	}()
+}
+
+func (p *LifecycleController) stop(instanceId string, reason string) {
+	p.act(instanceId, func() {
+		if !ioc.ContainerService().StopContainer(instanceId) {
+			return
+		}
+		actionsTotal.Inc(actionStop, reason)
+		slog.Info("Stopped container",
+			"instance_id", instanceId,
+			"reason", reason)
+	})
+}
+
+// restart replaces a running container with one launched from the current
+// deployment, so the instance stays warm
+func (p *LifecycleController) restart(deployment ioc.IDeployment, reason string) {
+	p.act(deployment.InstanceId(), func() {
+		containers := ioc.ContainerService()
+		if !containers.StopContainer(deployment.InstanceId()) {
+			return
+		}
+		actionsTotal.Inc(actionRestart, reason)
+
+		container, err := containers.GetOrCreateContainer(deployment)
+		if err != nil {
+			slog.Warn("Failed to restart container",
+				"instance_id", deployment.InstanceId(),
+				"reason", reason,
+				"error", err)
+			return
+		}
+		container.Release()
+		slog.Info("Restarted container",
+			"instance_id", deployment.InstanceId(),
+			"reason", reason)
+	})
+}
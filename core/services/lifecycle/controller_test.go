@@ -0,0 +1,290 @@
+package lifecycle
+
+import (
+	"net/url"
+	"os"
+	"pocker/core/ioc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const thisMachine = "self"
+
+type fakeMachineInfo struct{}
+
+func (fakeMachineInfo) Start()            {}
+func (fakeMachineInfo) MachineId() string { return thisMachine }
+func (fakeMachineInfo) Region() string    { return "test" }
+func (fakeMachineInfo) PrivateIp() string { return "127.0.0.1" }
+func (fakeMachineInfo) AppName() string   { return "pocker-test" }
+func (fakeMachineInfo) PrintInfo()        {}
+
+type fakeDeployment struct {
+	id        string
+	machineId string
+	power     bool
+	suspended bool
+	version   string
+	secrets   map[string]string
+}
+
+func (d fakeDeployment) IsLegacy() bool                  { return false }
+func (d fakeDeployment) InstanceId() string              { return d.id }
+func (d fakeDeployment) Subdomain() string               { return d.id }
+func (d fakeDeployment) MachineId() string               { return d.machineId }
+func (d fakeDeployment) IsUserVerified() bool            { return true }
+func (d fakeDeployment) IsUserSuspended() bool           { return false }
+func (d fakeDeployment) IsInstanceSuspended() bool       { return d.suspended }
+func (d fakeDeployment) IsInstancePoweredOn() bool       { return d.power }
+func (d fakeDeployment) InstanceSuspendedReason() string { return "" }
+func (d fakeDeployment) UserSuspendedReason() string     { return "" }
+func (d fakeDeployment) PrivateUrl() *url.URL            { return nil }
+func (d fakeDeployment) IdleTtl() time.Duration          { return 0 }
+func (d fakeDeployment) Subscription() string            { return "" }
+func (d fakeDeployment) Version() string                 { return d.version }
+func (d fakeDeployment) Secrets() map[string]string      { return d.secrets }
+
+type fakeInstance struct {
+	id     string
+	userId string
+}
+
+func (i fakeInstance) GetFieldMap() map[string]string { return map[string]string{"id": i.id} }
+func (i fakeInstance) GetUserId() string              { return i.userId }
+func (i fakeInstance) GetMachineId() string           { return thisMachine }
+
+type fakeMothership struct {
+	ioc.IMothershipService
+	deployments map[string]fakeDeployment
+	instances   []fakeInstance
+}
+
+func (m *fakeMothership) GetDeploymentByInstanceId(instanceId string) (ioc.IDeployment, error) {
+	deployment, ok := m.deployments[instanceId]
+	if !ok {
+		return nil, ioc.ErrDeploymentNotFound
+	}
+	return deployment, nil
+}
+
+func (m *fakeMothership) OnInstanceChange(fn func(action string, instanceId string)) {}
+
+func (m *fakeMothership) OnUserChange(fn func(action string, userId string)) {}
+
+func (m *fakeMothership) GetInstancesByUserId(userId string) []ioc.IInstance {
+	instances := []ioc.IInstance{}
+	for _, instance := range m.instances {
+		if instance.userId == userId {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+type fakeContainer struct {
+	deployment ioc.IDeployment
+}
+
+func (c *fakeContainer) Url() *url.URL               { return nil }
+func (c *fakeContainer) Deployment() ioc.IDeployment { return c.deployment }
+func (c *fakeContainer) Release()                    {}
+func (c *fakeContainer) Status() ioc.ContainerStatus {
+	return ioc.ContainerStatus{Running: true}
+}
+
+type fakeContainerService struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	events     []string
+	// starting, when set, blocks GetOrCreateContainer until it is closed
+	starting chan struct{}
+	// stopping, when set, blocks StopContainer until it is closed
+	stopping chan struct{}
+}
+
+func (s *fakeContainerService) Start() {}
+
+func (s *fakeContainerService) GetOrCreateContainer(deployment ioc.IDeployment) (ioc.IContainer, error) {
+	if s.starting != nil {
+		<-s.starting
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := &fakeContainer{deployment: deployment}
+	s.containers[deployment.InstanceId()] = container
+	s.events = append(s.events, "start "+deployment.InstanceId())
+	return container, nil
+}
+
+func (s *fakeContainerService) GetContainer(instanceId string) (ioc.IContainer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container, ok := s.containers[instanceId]
+	return container, ok
+}
+
+func (s *fakeContainerService) StopContainer(instanceId string) bool {
+	if s.stopping != nil {
+		<-s.stopping
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[instanceId]; !ok {
+		return false
+	}
+	delete(s.containers, instanceId)
+	s.events = append(s.events, "stop "+instanceId)
+	return true
+}
+
+func (s *fakeContainerService) ContainerIds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.containers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+var (
+	mothership = &fakeMothership{}
+	containers = &fakeContainerService{}
+)
+
+func TestMain(m *testing.M) {
+	ioc.RegisterMachineInfoService(fakeMachineInfo{})
+	ioc.RegisterMothershipService(mothership)
+	ioc.RegisterContainerService(containers)
+	os.Exit(m.Run())
+}
+
+func TestReconcile(t *testing.T) {
+	running := fakeDeployment{id: "a", machineId: thisMachine, power: true, version: "0.23.4", secrets: map[string]string{"KEY": "1"}}
+
+	tests := []struct {
+		name    string
+		current *fakeDeployment
+		want    string
+	}{
+		{name: "unchanged", current: &running, want: ""},
+		{name: "powered off", current: &fakeDeployment{id: "a", machineId: thisMachine, version: "0.23.4", secrets: running.secrets}, want: "stop a"},
+		{name: "suspended", current: &fakeDeployment{id: "a", machineId: thisMachine, power: true, suspended: true, version: "0.23.4", secrets: running.secrets}, want: "stop a"},
+		{name: "moved", current: &fakeDeployment{id: "a", machineId: "other", power: true, version: "0.23.4", secrets: running.secrets}, want: "stop a"},
+		{name: "deleted", current: nil, want: "stop a"},
+		{name: "version changed", current: &fakeDeployment{id: "a", machineId: thisMachine, power: true, version: "0.24.0", secrets: running.secrets}, want: "stop a,start a"},
+		{name: "secrets changed", current: &fakeDeployment{id: "a", machineId: thisMachine, power: true, version: "0.23.4", secrets: map[string]string{"KEY": "2"}}, want: "stop a,start a"},
+	}
+
+	controller := New(LifecycleControllerConfig{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			containers.containers = map[string]*fakeContainer{"a": {deployment: running}}
+			containers.events = nil
+			mothership.deployments = map[string]fakeDeployment{}
+			if tt.current != nil {
+				mothership.deployments["a"] = *tt.current
+			}
+
+			controller.reconcile("a")
+			controller.actions.Wait()
+
+			if got := strings.Join(containers.events, ","); got != tt.want {
+				t.Fatalf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileIgnoresInstancesWithoutContainer(t *testing.T) {
+	containers.containers = map[string]*fakeContainer{}
+	containers.events = nil
+	mothership.deployments = map[string]fakeDeployment{}
+
+	New(LifecycleControllerConfig{}).reconcile("missing")
+
+	if len(containers.events) != 0 {
+		t.Fatalf("unexpected events %v", containers.events)
+	}
+}
+
+func TestRestartDoesNotBlockReconcile(t *testing.T) {
+	running := fakeDeployment{id: "a", machineId: thisMachine, power: true, version: "0.23.4"}
+	containers.containers = map[string]*fakeContainer{"a": {deployment: running}}
+	containers.events = nil
+	containers.starting = make(chan struct{})
+	defer func() { containers.starting = nil }()
+	mothership.deployments = map[string]fakeDeployment{"a": {id: "a", machineId: thisMachine, power: true, version: "0.24.0"}}
+
+	controller := New(LifecycleControllerConfig{})
+	reconciled := make(chan struct{})
+	go func() {
+		controller.reconcile("a")
+		close(reconciled)
+	}()
+	select {
+	case <-reconciled:
+	case <-time.After(time.Second):
+		t.Fatal("reconcile waited for the restarted container to start")
+	}
+
+	close(containers.starting)
+	controller.actions.Wait()
+	if got := strings.Join(containers.events, ","); got != "stop a,start a" {
+		t.Fatalf("events = %q, want %q", got, "stop a,start a")
+	}
+}
+
+func TestStopDoesNotBlockReconcile(t *testing.T) {
+	containers.containers = map[string]*fakeContainer{"a": {deployment: fakeDeployment{id: "a", machineId: thisMachine, power: true}}}
+	containers.events = nil
+	containers.stopping = make(chan struct{})
+	defer func() { containers.stopping = nil }()
+	mothership.deployments = map[string]fakeDeployment{"a": {id: "a", machineId: thisMachine}}
+
+	controller := New(LifecycleControllerConfig{})
+	reconciled := make(chan struct{})
+	go func() {
+		controller.reconcile("a")
+		close(reconciled)
+	}()
+	select {
+	case <-reconciled:
+	case <-time.After(time.Second):
+		t.Fatal("reconcile waited for the container to stop")
+	}
+
+	// A change that arrives mid-stop is checked again once the stop is done
+	controller.reconcile("a")
+	close(containers.stopping)
+	controller.actions.Wait()
+	if got := strings.Join(containers.events, ","); got != "stop a" {
+		t.Fatalf("events = %q, want %q", got, "stop a")
+	}
+	select {
+	case instanceId := <-controller.queue:
+		if instanceId != "a" {
+			t.Fatalf("requeued %q, want a", instanceId)
+		}
+	default:
+		t.Fatal("change that arrived mid-stop wasn't requeued")
+	}
+}
+
+func TestUserChangeQueuesTheirInstances(t *testing.T) {
+	mothership.instances = []fakeInstance{{id: "a", userId: "u1"}, {id: "b", userId: "u1"}, {id: "c", userId: "u2"}}
+	defer func() { mothership.instances = nil }()
+
+	controller := New(LifecycleControllerConfig{})
+	controller.enqueueUser("update", "u1")
+
+	queued := []string{}
+	for len(controller.queue) > 0 {
+		queued = append(queued, <-controller.queue)
+	}
+	if got := strings.Join(queued, ","); got != "a,b" {
+		t.Fatalf("queued = %q, want %q", got, "a,b")
+	}
+}
@@ -1,16 +1,31 @@
 package port_range
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"pocker/core/ioc"
-	"pocker/core/syncx"
+	"pocker/core/metrics"
+	"strconv"
+	"sync"
 )
 
 var _ ioc.IPortService = (*FixedPortRangeProvider)(nil)
+var _ ioc.IReadinessService = (*FixedPortRangeProvider)(nil)
 
+// FixedPortRangeProvider hands out ports from a fixed range. Unused ports are
+// handed out first; released ports then come back in FIFO order, which gives
+// the previous listener's sockets time to drain.
 type FixedPortRangeProvider struct {
-	ports syncx.Pool[int]
+	mu        sync.Mutex
+	portStart int
+	portEnd   int
+	next      int
+	free      []int
+	allocated map[int]bool
+	// isPortFree reports whether nothing else is bound to the port
+	isPortFree func(port int) bool
 }
 
 type FixedPortRangeProviderConfig struct {
@@ -27,33 +42,101 @@ func New(config FixedPortRangeProviderConfig) ioc.IPortService {
 	if portEnd == 0 {
 		portEnd = 12000
 	}
-	maxPortAssigned := portStart
 
 	provider := FixedPortRangeProvider{
-		ports: syncx.Pool[int]{
-			New: func() int {
-				maxPortAssigned++
-				log.Printf("Allocating port: %d", maxPortAssigned)
-				if maxPortAssigned > portEnd {
-					log.Printf("No more ports available")
-					return 0
-				}
-				return maxPortAssigned
-			},
-		},
+		portStart:  portStart,
+		portEnd:    portEnd,
+		next:       portStart,
+		free:       []int{},
+		allocated:  map[int]bool{},
+		isPortFree: isPortFree,
 	}
 
 	return &provider
 }
 
 func (sm *FixedPortRangeProvider) AllocatePort() (int, error) {
-	port := sm.ports.Get()
-	if port == 0 {
-		return 0, fmt.Errorf("no more ports available")
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// Every port in the range is tried at most once per call
+	candidates := len(sm.free) + max(sm.portEnd-sm.next+1, 0)
+	for i := 0; i < candidates; i++ {
+		port := sm.nextCandidate()
+		if !sm.isPortFree(port) {
+			slog.Debug("Skipping port bound by another process", "port", port)
+			sm.free = append(sm.free, port)
+			continue
+		}
+		sm.allocated[port] = true
+		slog.Debug("Allocating port", "port", port)
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no more ports available")
+}
+
+// nextCandidate takes the next never-used port, or once the range has been
+// walked, the oldest released one
+func (sm *FixedPortRangeProvider) nextCandidate() int {
+	if sm.next <= sm.portEnd {
+		port := sm.next
+		sm.next++
+		return port
+	}
+	port := sm.free[0]
+	sm.free = sm.free[1:]
+	return port
+}
+
+func (sm *FixedPortRangeProvider) ReleasePort(port int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if !sm.allocated[port] {
+		slog.Warn("Releasing port that is not allocated", "port", port)
+		return
 	}
-	return port, nil
+	delete(sm.allocated, port)
+	sm.free = append(sm.free, port)
+	slog.Debug("Released port", "port", port)
 }
 
 func (sm *FixedPortRangeProvider) Start() {
+	metrics.NewGaugeFunc("pocker_ports_allocated",
+		"Ports currently allocated to containers.",
+		func() float64 {
+			return float64(sm.Allocated())
+		})
+}
 
+func (sm *FixedPortRangeProvider) ReadinessChecks() []ioc.ReadinessCheck {
+	return []ioc.ReadinessCheck{
+		{
+			Name:     "ports_available",
+			Required: true,
+			Check: func(ctx context.Context) error {
+				if allocated := sm.Allocated(); allocated >= sm.portEnd-sm.portStart+1 {
+					return fmt.Errorf("all %d ports are allocated", allocated)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Allocated returns how many ports are currently handed out
+func (sm *FixedPortRangeProvider) Allocated() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return len(sm.allocated)
+}
+
+func isPortFree(port int) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
 }
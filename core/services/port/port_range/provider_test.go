@@ -0,0 +1,98 @@
+package port_range
+
+import (
+	"testing"
+)
+
+func newTestProvider(start int, end int, busy map[int]bool) *FixedPortRangeProvider {
+	provider := New(FixedPortRangeProviderConfig{
+		PortRangeStart: start,
+		PortRangeEnd:   end,
+	}).(*FixedPortRangeProvider)
+	provider.isPortFree = func(port int) bool {
+		return !busy[port]
+	}
+	return provider
+}
+
+func TestFixedPortRangeProvider_Exhaustion(t *testing.T) {
+	provider := newTestProvider(20000, 20002, nil)
+
+	for _, want := range []int{20000, 20001, 20002} {
+		got, err := provider.AllocatePort()
+		if err != nil {
+			t.Fatalf("AllocatePort() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocatePort() = %d, want %d", got, want)
+		}
+	}
+
+	if _, err := provider.AllocatePort(); err == nil {
+		t.Error("AllocatePort() should fail when the range is exhausted")
+	}
+}
+
+func TestFixedPortRangeProvider_ReleaseReusesInOrder(t *testing.T) {
+	provider := newTestProvider(20000, 20002, nil)
+
+	for i := 0; i < 3; i++ {
+		if _, err := provider.AllocatePort(); err != nil {
+			t.Fatalf("AllocatePort() error = %v", err)
+		}
+	}
+
+	provider.ReleasePort(20001)
+	provider.ReleasePort(20000)
+
+	for _, want := range []int{20001, 20000} {
+		got, err := provider.AllocatePort()
+		if err != nil {
+			t.Fatalf("AllocatePort() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("AllocatePort() = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestFixedPortRangeProvider_DoubleRelease(t *testing.T) {
+	provider := newTestProvider(20000, 20000, nil)
+
+	port, err := provider.AllocatePort()
+	if err != nil {
+		t.Fatalf("AllocatePort() error = %v", err)
+	}
+	provider.ReleasePort(port)
+	provider.ReleasePort(port)
+
+	if _, err := provider.AllocatePort(); err != nil {
+		t.Fatalf("AllocatePort() error = %v", err)
+	}
+	if _, err := provider.AllocatePort(); err == nil {
+		t.Error("a port released twice should only be handed out once")
+	}
+}
+
+func TestFixedPortRangeProvider_SkipsBoundPorts(t *testing.T) {
+	busy := map[int]bool{20000: true}
+	provider := newTestProvider(20000, 20001, busy)
+
+	got, err := provider.AllocatePort()
+	if err != nil {
+		t.Fatalf("AllocatePort() error = %v", err)
+	}
+	if got != 20001 {
+		t.Errorf("AllocatePort() = %d, want 20001", got)
+	}
+
+	// Once the other process lets go, the skipped port is used again
+	delete(busy, 20000)
+	got, err = provider.AllocatePort()
+	if err != nil {
+		t.Fatalf("AllocatePort() error = %v", err)
+	}
+	if got != 20000 {
+		t.Errorf("AllocatePort() = %d, want 20000", got)
+	}
+}
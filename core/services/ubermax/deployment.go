@@ -1,18 +1,23 @@
 package ubermax
 
 import (
+	"log/slog"
 	"net/url"
 	"pocker/core/ioc"
+	"pocker/core/services/ubermax/mothership/models"
+	"time"
 )
 
 var _ ioc.IDeployment = (*Deployment)(nil)
 
 type Deployment struct {
-	instance *Instance
+	instance *models.Instance
+	user     *models.User
+	ubermax  *Ubermax
 }
 
-func NewDeployment(instance *Instance) ioc.IDeployment {
-	return &Deployment{instance: instance}
+func NewDeployment(instance *models.Instance, user *models.User, ubermax *Ubermax) ioc.IDeployment {
+	return &Deployment{instance: instance, user: user, ubermax: ubermax}
 }
 
 func (d *Deployment) IsLegacy() bool {
@@ -23,34 +28,63 @@ func (d *Deployment) InstanceId() string {
 	return d.instance.Id
 }
 
+func (d *Deployment) Subdomain() string {
+	return d.instance.Subdomain
+}
+
 func (d *Deployment) MachineId() string {
 	return d.instance.MachineId
 }
 
 func (d *Deployment) IsUserVerified() bool {
-	return true
+	return d.user.Verified
 }
 
 func (d *Deployment) IsUserSuspended() bool {
-	return false
+	return d.user.Suspension != ""
 }
 
 func (d *Deployment) IsInstanceSuspended() bool {
-	return false
+	return d.instance.Suspension != ""
 }
 
 func (d *Deployment) IsInstancePoweredOn() bool {
-	return true
+	return d.instance.Power
 }
 
 func (d *Deployment) InstanceSuspendedReason() string {
-	return ""
+	return d.instance.Suspension
 }
 
 func (d *Deployment) UserSuspendedReason() string {
-	return ""
+	return d.user.Suspension
+}
+
+// IdleTtl is zero when the instance leaves it to the container service default
+func (d *Deployment) IdleTtl() time.Duration {
+	return time.Duration(d.instance.IdleTtl) * time.Second
+}
+
+func (d *Deployment) Subscription() string {
+	return d.user.Subscription
+}
+
+func (d *Deployment) Version() string {
+	return d.instance.Version
+}
+
+func (d *Deployment) Secrets() map[string]string {
+	return d.instance.Secrets
 }
 
 func (d *Deployment) PrivateUrl() *url.URL {
-	return nil
+	privateUrl, err := d.ubermax.privateUrlForMachine(d.instance.MachineId)
+	if err != nil {
+		slog.Warn("Failed to resolve private url",
+			"instance_id", d.instance.Id,
+			"machine_id", d.instance.MachineId,
+			"error", err)
+		return nil
+	}
+	return privateUrl
 }
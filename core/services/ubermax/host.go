@@ -0,0 +1,82 @@
+package ubermax
+
+import (
+	"fmt"
+	"net"
+	"pocker/core/ioc"
+	"pocker/core/services/ubermax/mothership/models"
+	"strings"
+)
+
+type instanceLookup func(key string) (*models.Instance, error)
+
+// normalizeHost strips the port and any trailing dot from a Host header and
+// lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// subdomainFromHost returns the instance subdomain when host sits directly
+// under apexDomain. With no apex domain configured, the first label is used.
+func subdomainFromHost(host string, apexDomain string) (string, bool) {
+	if apexDomain == "" {
+		subdomain, _, found := strings.Cut(host, ".")
+		if !found || subdomain == "" {
+			return "", false
+		}
+		return subdomain, true
+	}
+
+	subdomain, found := strings.CutSuffix(host, "."+strings.ToLower(apexDomain))
+	if !found || subdomain == "" || strings.Contains(subdomain, ".") {
+		return "", false
+	}
+	return subdomain, true
+}
+
+// resolveHost finds the instance a normalized host routes to. A configured
+// apex domain owns its subdomains outright and anything else is a cname.
+// Without one, an active cname such as api.customer.com wins over the
+// instance whose subdomain is its first label.
+func resolveHost(host string, apexDomain string, bySubdomain instanceLookup, byCname instanceLookup) (*models.Instance, error) {
+	if apexDomain != "" {
+		subdomain, ok := subdomainFromHost(host, apexDomain)
+		if !ok {
+			return resolveCname(host, byCname)
+		}
+		instance, err := bySubdomain(subdomain)
+		if err != nil {
+			return nil, fmt.Errorf("%w: subdomain %s: %v", ioc.ErrDeploymentNotFound, subdomain, err)
+		}
+		return instance, nil
+	}
+
+	instance, err := resolveCname(host, byCname)
+	if err == nil {
+		return instance, nil
+	}
+	subdomain, ok := subdomainFromHost(host, "")
+	if !ok {
+		return nil, err
+	}
+	instance, subdomainErr := bySubdomain(subdomain)
+	if subdomainErr != nil {
+		return nil, fmt.Errorf("%w: host %s: %v", ioc.ErrDeploymentNotFound, host, subdomainErr)
+	}
+	return instance, nil
+}
+
+// resolveCname only matches instances whose cname is active
+func resolveCname(host string, byCname instanceLookup) (*models.Instance, error) {
+	instance, err := byCname(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: host %s: %v", ioc.ErrDeploymentNotFound, host, err)
+	}
+	if !instance.CnameActive {
+		return nil, fmt.Errorf("%w: cname %s is not active", ioc.ErrDeploymentNotFound, host)
+	}
+	return instance, nil
+}
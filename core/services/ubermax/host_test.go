@@ -0,0 +1,136 @@
+package ubermax
+
+import (
+	"errors"
+	"pocker/core/ioc"
+	"pocker/core/services/ubermax/mothership/models"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "app.pockethost.io", want: "app.pockethost.io"},
+		{host: "App.PocketHost.IO", want: "app.pockethost.io"},
+		{host: "app.pockethost.io:8080", want: "app.pockethost.io"},
+		{host: "app.pockethost.io.", want: "app.pockethost.io"},
+		{host: "App.PocketHost.io.:443", want: "app.pockethost.io"},
+		{host: "[::1]:8080", want: "::1"},
+		{host: "localhost", want: "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := normalizeHost(tt.host); got != tt.want {
+				t.Errorf("normalizeHost(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubdomainFromHost(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		apex   string
+		want   string
+		wantOk bool
+	}{
+		{name: "under apex", host: "app.pockethost.io", apex: "pockethost.io", want: "app", wantOk: true},
+		{name: "apex is case insensitive", host: "app.pockethost.io", apex: "PocketHost.io", want: "app", wantOk: true},
+		{name: "nested under apex", host: "api.app.pockethost.io", apex: "pockethost.io"},
+		{name: "apex itself", host: "pockethost.io", apex: "pockethost.io"},
+		{name: "other domain", host: "app.customer.com", apex: "pockethost.io"},
+		{name: "suffix without a dot", host: "apppockethost.io", apex: "pockethost.io"},
+		{name: "no apex uses first label", host: "app.customer.com", want: "app", wantOk: true},
+		{name: "no apex and one label", host: "localhost"},
+		{name: "no apex and empty first label", host: ".pockethost.io"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := subdomainFromHost(tt.host, tt.apex)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("subdomainFromHost(%q, %q) = %q, %v, want %q, %v", tt.host, tt.apex, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	instance := func(id string, subdomain string, cname string, active bool) *models.Instance {
+		instance := models.NewInstance()
+		instance.Id = id
+		instance.Subdomain = subdomain
+		instance.Cname = cname
+		instance.CnameActive = active
+		return instance
+	}
+	instances := []*models.Instance{
+		instance("app", "app", "", false),
+		// Its subdomain is the first label of another instance's cname
+		instance("api", "api", "", false),
+		instance("custom", "custom", "API.Customer.com", true),
+		instance("pending", "pending", "www.pending.com", false),
+		// Its cname sits under the apex
+		instance("vanity", "vanity", "shop.app.pockethost.io", true),
+	}
+	// Index them the way the mirror does
+	bySubdomain := func(subdomain string) (*models.Instance, error) {
+		for _, instance := range instances {
+			if instance.GetFieldMap()["subdomain"] == subdomain {
+				return instance, nil
+			}
+		}
+		return nil, errors.New("not found")
+	}
+	byCname := func(cname string) (*models.Instance, error) {
+		for _, instance := range instances {
+			if instance.Cname != "" && instance.GetFieldMap()["cname"] == strings.ToLower(cname) {
+				return instance, nil
+			}
+		}
+		return nil, errors.New("not found")
+	}
+
+	tests := []struct {
+		name string
+		host string
+		apex string
+		want string
+	}{
+		{name: "subdomain under apex", host: "app.pockethost.io", apex: "pockethost.io", want: "app"},
+		{name: "unknown subdomain under apex", host: "missing.pockethost.io", apex: "pockethost.io"},
+		{name: "apex owns its subdomains", host: "api.pockethost.io", apex: "pockethost.io", want: "api"},
+		{name: "cname with apex", host: "api.customer.com", apex: "pockethost.io", want: "custom"},
+		{name: "nested under apex is a cname", host: "shop.app.pockethost.io", apex: "pockethost.io", want: "vanity"},
+		{name: "unknown nested under apex", host: "a.b.pockethost.io", apex: "pockethost.io"},
+		{name: "inactive cname with apex", host: "www.pending.com", apex: "pockethost.io"},
+		{name: "subdomain without apex", host: "app.pockethost.io", want: "app"},
+		{name: "cname wins over subdomain without apex", host: "api.customer.com", want: "custom"},
+		{name: "inactive cname falls back to subdomain without apex", host: "www.pending.com"},
+		{name: "unknown without apex", host: "missing.customer.com"},
+		{name: "one label without apex", host: "localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveHost(tt.host, tt.apex, bySubdomain, byCname)
+			if tt.want == "" {
+				if !errors.Is(err, ioc.ErrDeploymentNotFound) {
+					t.Fatalf("resolveHost(%q) = %v, %v, want ErrDeploymentNotFound", tt.host, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveHost(%q) error = %v", tt.host, err)
+			}
+			if got.Id != tt.want {
+				t.Errorf("resolveHost(%q) = %s, want %s", tt.host, got.Id, tt.want)
+			}
+		})
+	}
+}
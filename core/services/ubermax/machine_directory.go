@@ -0,0 +1,64 @@
+package ubermax
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// machineEntry mirrors a record in machines.json, the static machine list
+// used when the mothership has no privateUrl for a machine.
+type machineEntry struct {
+	MachineId string `json:"machineId"`
+	Name      string `json:"name"`
+	Region    string `json:"region"`
+	PrivateIp string `json:"privateIp"`
+}
+
+type machineDirectory struct {
+	entries map[string]machineEntry
+	port    int
+}
+
+func loadMachineDirectory(path string, port int) *machineDirectory {
+	directory := &machineDirectory{
+		entries: map[string]machineEntry{},
+		port:    port,
+	}
+	if path == "" {
+		return directory
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("Failed to read machines file", "path", path, "error", err)
+		return directory
+	}
+
+	entries := []machineEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		slog.Warn("Failed to parse machines file", "path", path, "error", err)
+		return directory
+	}
+
+	for _, entry := range entries {
+		directory.entries[entry.MachineId] = entry
+	}
+	slog.Debug("Loaded machines file", "path", path, "count", len(directory.entries))
+	return directory
+}
+
+func (d *machineDirectory) privateUrl(machineId string) (*url.URL, error) {
+	entry, ok := d.entries[machineId]
+	if !ok || entry.PrivateIp == "" {
+		return nil, fmt.Errorf("machine %s not found", machineId)
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(entry.PrivateIp, strconv.Itoa(d.port)),
+	}, nil
+}
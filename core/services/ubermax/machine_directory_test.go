@@ -0,0 +1,56 @@
+package ubermax
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMachineDirectory(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	machines := write("machines.json", `[
+		{"machineId": "v4", "name": "one", "region": "sjc", "privateIp": "10.0.0.1"},
+		{"machineId": "v6", "name": "two", "region": "ams", "privateIp": "fdaa::2"},
+		{"machineId": "no-ip", "name": "three", "region": "sjc"}
+	]`)
+
+	tests := []struct {
+		name      string
+		path      string
+		machineId string
+		want      string
+	}{
+		{name: "ipv4", path: machines, machineId: "v4", want: "http://10.0.0.1:8080"},
+		{name: "ipv6", path: machines, machineId: "v6", want: "http://[fdaa::2]:8080"},
+		{name: "no private ip", path: machines, machineId: "no-ip"},
+		{name: "unknown machine", path: machines, machineId: "missing"},
+		{name: "no file configured", path: "", machineId: "v4"},
+		{name: "missing file", path: filepath.Join(dir, "missing.json"), machineId: "v4"},
+		{name: "malformed file", path: write("malformed.json", `{"machineId": "v4"}`), machineId: "v4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMachineDirectory(tt.path, 8080).privateUrl(tt.machineId)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("privateUrl(%q) = %s, want an error", tt.machineId, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("privateUrl(%q) error = %v", tt.machineId, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("privateUrl(%q) = %s, want %s", tt.machineId, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package mirror
 
 import (
 	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
-	"pocker/core/providers/deployment/ubermax/mothership/models"
+	"pocker/core/metrics"
+	"pocker/core/services/ubermax/mothership/models"
 
 	"github.com/pluja/pocketbase"
 )
@@ -13,8 +17,10 @@ type ICacheable interface {
 }
 
 type MirrorData struct {
-	Users     []models.User     `json:"users"`
-	Instances []models.Instance `json:"instances"`
+	SavedAt   time.Time          `json:"savedAt"`
+	Users     []*models.User     `json:"users"`
+	Instances []*models.Instance `json:"instances"`
+	Machines  []*models.Machine  `json:"machines"`
 }
 
 type MirrorManager struct {
@@ -22,44 +28,202 @@ type MirrorManager struct {
 	users     *MirrorCache[*models.User]
 	machines  *MirrorCache[*models.Machine]
 	config    MirrorManagerConfig
+
+	listenersMu       sync.Mutex
+	instanceListeners []func(e *pocketbase.TypedEvent[*models.Instance])
+	userListeners     []func(e *pocketbase.TypedEvent[*models.User])
+
+	stopOnce sync.Once
+	stopped  chan struct{}
 }
 
 type MirrorManagerConfig struct {
-	Client   *pocketbase.Client
-	SseDebug bool
+	Client       *pocketbase.Client
+	SseDebug     bool
+	Authenticate func() error
+	// SnapshotPath is where the mirror is persisted for cold starts. Empty
+	// disables persistence.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
 }
 
 func NewMirrorManager(config MirrorManagerConfig) *MirrorManager {
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = time.Minute
+	}
 	return &MirrorManager{
 		instances: newMirrorCache(MirrorCacheConfig[*models.Instance]{
 			Client:         config.Client,
 			Debug:          config.SseDebug,
+			Authenticate:   config.Authenticate,
 			CollectionName: "instances",
-			Fields:         []string{"id", "cname", "subdomain", "supension", "uid"},
-			Factory:        models.NewInstance,
+			Fields: []string{"id", "cname", "cname_active", "subdomain", "suspension", "uid",
+				"machineId", "power", "status", "idleTtl", "version", "secrets", "dev", "region", "updated"},
+			Factory: models.NewInstance,
 		}),
 		users: newMirrorCache(MirrorCacheConfig[*models.User]{
 			Client:         config.Client,
 			Debug:          config.SseDebug,
+			Authenticate:   config.Authenticate,
 			CollectionName: "users",
-			Fields:         []string{"id", "email", "verified", "suspension", "double_verified"},
+			Fields:         []string{"id", "email", "verified", "suspension", "double_verified", "subscription"},
 			Factory:        models.NewUser,
 		}),
 		machines: newMirrorCache(MirrorCacheConfig[*models.Machine]{
 			Client:         config.Client,
 			Debug:          config.SseDebug,
+			Authenticate:   config.Authenticate,
 			CollectionName: "machines",
 			Fields:         []string{"id", "name", "uuid", "privateUrl"},
 			Factory:        models.NewMachine,
 		}),
-		config: config,
+		config:  config,
+		stopped: make(chan struct{}),
 	}
 }
 
 func (p *MirrorManager) Start() {
 	slog.Info("Starting mirror manager")
 
-	p.instances.StartMirroring()
-	p.users.StartMirroring()
-	p.machines.StartMirroring()
+	p.dispatchInstanceEvents(p.instances.StartMirroring())
+	p.dispatchUserEvents(p.users.StartMirroring())
+	drain(p.machines.StartMirroring())
+
+	metrics.NewGaugeVecFunc("pocker_mirror_records",
+		"Records held in the mothership mirror, by collection.",
+		"collection",
+		func() map[string]float64 {
+			return map[string]float64{
+				"instances": float64(p.instances.Len()),
+				"users":     float64(p.users.Len()),
+				"machines":  float64(p.machines.Len()),
+			}
+		})
+
+	if p.config.SnapshotPath != "" {
+		go p.persistPeriodically()
+	}
+}
+
+// Stop closes every realtime stream and, when persistence is enabled, writes
+// a final snapshot so the next boot starts as fresh as possible
+func (p *MirrorManager) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+	p.instances.StopMirroring()
+	p.users.StopMirroring()
+	p.machines.StopMirroring()
+
+	if p.config.SnapshotPath != "" && !p.IsStale() {
+		if err := p.SaveSnapshot(); err != nil {
+			slog.Warn("Failed to persist mirror snapshot", "path", p.config.SnapshotPath, "error", err)
+		}
+	}
+}
+
+// WaitForSync blocks until every collection has loaded its initial snapshot
+func (p *MirrorManager) WaitForSync() {
+	<-p.instances.Synced()
+	<-p.users.Synced()
+	<-p.machines.Synced()
+}
+
+func (p *MirrorManager) IsSynced() bool {
+	return p.instances.IsSynced() && p.users.IsSynced() && p.machines.IsSynced()
+}
+
+// IsStale reports whether any collection is being served from a snapshot
+// that the live stream has not caught up with yet
+func (p *MirrorManager) IsStale() bool {
+	return !p.instances.IsLive() || !p.users.IsLive() || !p.machines.IsLive()
+}
+
+// OnInstanceEvent registers fn to be called for every instance event the
+// mirror applies, including deletions found during a resync. fn runs on the
+// mirroring goroutine and must not block.
+func (p *MirrorManager) OnInstanceEvent(fn func(e *pocketbase.TypedEvent[*models.Instance])) {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	p.instanceListeners = append(p.instanceListeners, fn)
+}
+
+// OnUserEvent registers fn to be called for every user event the mirror
+// applies. Like OnInstanceEvent, fn must not block.
+func (p *MirrorManager) OnUserEvent(fn func(e *pocketbase.TypedEvent[*models.User])) {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	p.userListeners = append(p.userListeners, fn)
+}
+
+// dispatchInstanceEvents hands instance events to the registered listeners,
+// draining the channel when there are none
+func (p *MirrorManager) dispatchInstanceEvents(ch chan *pocketbase.TypedEvent[*models.Instance]) {
+	go func() {
+		for e := range ch {
+			p.listenersMu.Lock()
+			listeners := append([]func(e *pocketbase.TypedEvent[*models.Instance]){}, p.instanceListeners...)
+			p.listenersMu.Unlock()
+
+			for _, fn := range listeners {
+				fn(e)
+			}
+		}
+	}()
+}
+
+// drain discards mirror events nobody is listening for so the mirroring
+// goroutine never blocks on send
+// dispatchUserEvents hands user events to the registered listeners,
+// draining the channel when there are none
+func (p *MirrorManager) dispatchUserEvents(ch chan *pocketbase.TypedEvent[*models.User]) {
+	go func() {
+		for e := range ch {
+			p.listenersMu.Lock()
+			listeners := append([]func(e *pocketbase.TypedEvent[*models.User]){}, p.userListeners...)
+			p.listenersMu.Unlock()
+
+			for _, fn := range listeners {
+				fn(e)
+			}
+		}
+	}()
+}
+
+func drain[T any](ch chan T) {
+	go func() {
+		for range ch {
+		}
+	}()
+}
+
+func (p *MirrorManager) GetInstanceById(id string) (*models.Instance, bool) {
+	return p.instances.Get("id", id)
+}
+
+func (p *MirrorManager) GetInstanceBySubdomain(subdomain string) (*models.Instance, bool) {
+	return p.instances.Get("subdomain", subdomain)
+}
+
+// GetInstanceByCname matches cnames case-insensitively, as DNS does
+func (p *MirrorManager) GetInstanceByCname(cname string) (*models.Instance, bool) {
+	return p.instances.Get("cname", strings.ToLower(cname))
+}
+
+func (p *MirrorManager) GetInstancesByUserId(userId string) []*models.Instance {
+	return p.instances.Filter(func(instance *models.Instance) bool {
+		return instance.Uid == userId
+	})
+}
+
+func (p *MirrorManager) GetUserById(id string) (*models.User, bool) {
+	return p.users.Get("id", id)
+}
+
+func (p *MirrorManager) GetMachineById(id string) (*models.Machine, bool) {
+	return p.machines.Get("id", id)
+}
+
+func (p *MirrorManager) GetMachineByUuid(uuid string) (*models.Machine, bool) {
+	return p.machines.Get("uuid", uuid)
 }
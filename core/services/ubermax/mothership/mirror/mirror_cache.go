@@ -1,13 +1,23 @@
 package mirror
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"pocker/core/syncx"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pluja/pocketbase"
 )
 
+const (
+	snapshotPageSize    = 500
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
 type MirrorCache[T syncx.IIndexedCacheItem] struct {
 	collectionName string
 	fields         []string
@@ -16,6 +26,19 @@ type MirrorCache[T syncx.IIndexedCacheItem] struct {
 	debug          bool
 	cache          *syncx.IndexedCache[T]
 	factory        func() T
+	authenticate   func() error
+
+	// Events that arrive while a snapshot is loading are held in pending and
+	// replayed on top of the snapshot once it is complete. synced flips once,
+	// after the first snapshot; live is false during every resync.
+	syncMu   sync.Mutex
+	synced   bool
+	live     bool
+	pending  []*pocketbase.TypedEvent[T]
+	syncedCh chan struct{}
+
+	stopOnce sync.Once
+	stopped  chan struct{}
 }
 
 type MirrorCacheConfig[T syncx.IIndexedCacheItem] struct {
@@ -24,6 +47,7 @@ type MirrorCacheConfig[T syncx.IIndexedCacheItem] struct {
 	Fields         []string
 	Debug          bool
 	Factory        func() T
+	Authenticate   func() error
 }
 
 func newMirrorCache[T syncx.IIndexedCacheItem](config MirrorCacheConfig[T]) *MirrorCache[T] {
@@ -39,7 +63,10 @@ func newMirrorCache[T syncx.IIndexedCacheItem](config MirrorCacheConfig[T]) *Mir
 		cache: syncx.NewIndexedCache[T](syncx.IndexedCacheConfig{
 			Debug: config.Debug,
 		}),
-		factory: config.Factory,
+		factory:      config.Factory,
+		authenticate: config.Authenticate,
+		syncedCh:     make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 	return mirror
 
@@ -53,46 +80,298 @@ func (p *MirrorCache[T]) StartMirroring() chan *pocketbase.TypedEvent[T] {
 		slog.Error("collection name is required")
 	}
 
-	stream, err := collection.Subscribe(pocketbase.WithTarget(p.collectionName, pocketbase.WithFields(p.fields...)))
-	if err != nil {
-		slog.Error("Failed to subscribe", slog.String("collection_name", p.collectionName), slog.Any("error", err))
-	}
-	p.stream = stream
-
 	ch := make(chan *pocketbase.TypedEvent[T])
 
 	go func() {
-		for e := range stream.C {
-			fmt.Printf("event: %+v\n", e)
-			if p.debug {
-				slog.Debug("event", slog.String("collection_name", p.collectionName), slog.Any("event", e))
+		defer close(ch)
+		backoff := minReconnectBackoff
+		for {
+			resynced, err := p.mirrorOnce(collection, ch)
+			if resynced {
+				backoff = minReconnectBackoff
 			}
-			switch e.Action {
-			case "create", "update":
-				slog.Debug("upserting", slog.String("collection_name", p.collectionName), slog.Any("record", e.Record))
-				p.cache.Upsert(e.Record)
-				if p.debug {
-					slog.Debug("upserted", slog.String("collection_name", p.collectionName), slog.Any("action", e.Action), slog.Any("record", e.Record))
-				}
-				ch <- e
-			case "delete":
-				id, ok := (*e.Fields)["id"]
-				if !ok {
-					slog.Error("delete event for %s has no id", slog.String("collection_name", p.collectionName))
-					continue
-				}
-				p.cache.DeleteByFieldNameAndValue("id", id.(string))
-				if p.debug {
-					slog.Debug("deleted", slog.String("collection_name", p.collectionName), slog.String("id", id.(string)))
+			select {
+			case <-p.stopped:
+				slog.Info("Stopped mirroring", slog.String("collection_name", p.collectionName))
+				return
+			default:
+			}
+			slog.Warn("Mirror stream ended. Reconnecting",
+				slog.String("collection_name", p.collectionName),
+				slog.Duration("backoff", backoff),
+				slog.Any("error", err))
+			select {
+			case <-time.After(backoff):
+			case <-p.stopped:
+				slog.Info("Stopped mirroring", slog.String("collection_name", p.collectionName))
+				return
+			}
+			backoff = min(backoff*2, maxReconnectBackoff)
+
+			if p.authenticate != nil {
+				if err := p.authenticate(); err != nil {
+					slog.Warn("Failed to re-authenticate mirror", slog.String("collection_name", p.collectionName), slog.Any("error", err))
 				}
-				ch <- e
 			}
 		}
 	}()
+
 	return ch
 
 }
 
+// mirrorOnce subscribes to the collection, resyncs it from a full snapshot
+// and then applies realtime events until the stream closes. It reports
+// whether the resync completed.
+func (p *MirrorCache[T]) mirrorOnce(collection *pocketbase.Collection[T], ch chan *pocketbase.TypedEvent[T]) (bool, error) {
+	p.syncMu.Lock()
+	p.live = false
+	p.pending = nil
+	p.syncMu.Unlock()
+
+	// Subscribe before listing so nothing that changes during the snapshot
+	// is missed
+	stream, err := collection.Subscribe(pocketbase.WithTarget(p.collectionName, pocketbase.WithFields(p.fields...)))
+	if err != nil {
+		return false, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	p.stream = stream
+	unsubscribe := sync.OnceFunc(stream.Unsubscribe)
+	defer unsubscribe()
+
+	streamEnded := make(chan struct{})
+	defer close(streamEnded)
+	go func() {
+		select {
+		case <-p.stopped:
+			unsubscribe()
+		case <-streamEnded:
+		}
+	}()
+
+	resynced := false
+	resyncDone := make(chan struct{})
+	go func() {
+		defer close(resyncDone)
+		if err := p.resync(collection, ch); err != nil {
+			slog.Warn("Failed to resync mirror",
+				slog.String("collection_name", p.collectionName),
+				slog.Any("error", err))
+			unsubscribe()
+			return
+		}
+		resynced = true
+	}()
+
+	for e := range stream.C {
+		// Records carry tenant secrets, so only the action is logged
+		if p.debug {
+			slog.Debug("event", slog.String("collection_name", p.collectionName), slog.String("action", e.Action))
+		}
+
+		p.syncMu.Lock()
+		if !p.live {
+			p.pending = append(p.pending, e)
+			p.syncMu.Unlock()
+			continue
+		}
+		p.syncMu.Unlock()
+
+		if p.applyEvent(e) {
+			ch <- e
+		}
+	}
+
+	<-resyncDone
+	return resynced, errors.New("stream closed")
+}
+
+// resync loads a full snapshot, replays the events that arrived meanwhile
+// and evicts records that were deleted while we were not listening. The
+// resulting events are sent once syncMu is released, so a slow listener
+// can't hold up IsSynced, IsLive or the stream. Listeners may see them after
+// newer live events for the same record.
+func (p *MirrorCache[T]) resync(collection *pocketbase.Collection[T], ch chan *pocketbase.TypedEvent[T]) error {
+	seen, err := p.loadSnapshot(collection)
+	if err != nil {
+		return err
+	}
+
+	p.syncMu.Lock()
+	events := []*pocketbase.TypedEvent[T]{}
+	pending := p.pending
+	p.pending = nil
+	for _, e := range pending {
+		if e.Action != "delete" {
+			seen[e.Record.GetFieldMap()["id"]] = true
+		}
+		if p.applyEvent(e) {
+			events = append(events, e)
+		}
+	}
+
+	stale := []T{}
+	p.cache.Range(func(item T) bool {
+		if !seen[item.GetFieldMap()["id"]] {
+			stale = append(stale, item)
+		}
+		return true
+	})
+	for _, item := range stale {
+		id := item.GetFieldMap()["id"]
+		p.cache.Delete(item)
+		events = append(events, &pocketbase.TypedEvent[T]{
+			Action: "delete",
+			Record: item,
+			Fields: &map[string]any{"id": id},
+		})
+	}
+
+	p.live = true
+	if !p.synced {
+		p.synced = true
+		close(p.syncedCh)
+	}
+	p.syncMu.Unlock()
+
+	for _, e := range events {
+		ch <- e
+	}
+	slog.Info("Mirror synced",
+		slog.String("collection_name", p.collectionName),
+		slog.Int("replayed_events", len(pending)),
+		slog.Int("evicted", len(stale)))
+	return nil
+}
+
+// loadSnapshot pages through the whole collection, upserts every record and
+// returns the ids it saw
+func (p *MirrorCache[T]) loadSnapshot(collection *pocketbase.Collection[T]) (map[string]bool, error) {
+	seen := map[string]bool{}
+	for page := 1; ; page++ {
+		response, err := collection.List(pocketbase.ParamsList{
+			Page:   page,
+			Size:   snapshotPageSize,
+			Fields: strings.Join(p.fields, ","),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list page %d: %w", page, err)
+		}
+		for _, record := range response.Items {
+			p.cache.Upsert(record)
+			seen[record.GetFieldMap()["id"]] = true
+		}
+		if page >= response.TotalPages || len(response.Items) == 0 {
+			break
+		}
+	}
+	slog.Info("Loaded snapshot",
+		slog.String("collection_name", p.collectionName),
+		slog.Int("count", len(seen)))
+	return seen, nil
+}
+
+// applyEvent writes a realtime event into the cache and reports whether it
+// should be forwarded to listeners
+func (p *MirrorCache[T]) applyEvent(e *pocketbase.TypedEvent[T]) bool {
+	switch e.Action {
+	case "create", "update":
+		p.cache.Upsert(e.Record)
+		if p.debug {
+			slog.Debug("upserted", slog.String("collection_name", p.collectionName), slog.String("action", e.Action), slog.String("id", e.Record.GetFieldMap()["id"]))
+		}
+		return true
+	case "delete":
+		id, ok := (*e.Fields)["id"]
+		if !ok {
+			slog.Error("delete event has no id", slog.String("collection_name", p.collectionName))
+			return false
+		}
+		p.cache.DeleteByFieldNameAndValue("id", id.(string))
+		if p.debug {
+			slog.Debug("deleted", slog.String("collection_name", p.collectionName), slog.String("id", id.(string)))
+		}
+		return true
+	}
+	return false
+}
+
+// IsSynced reports whether the initial snapshot has been loaded
+func (p *MirrorCache[T]) IsSynced() bool {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	return p.synced
+}
+
+// StopMirroring closes the realtime stream and stops reconnecting. The event
+// channel returned by StartMirroring is closed once the stream has wound down.
+func (p *MirrorCache[T]) StopMirroring() {
+	p.stopOnce.Do(func() {
+		close(p.stopped)
+	})
+}
+
+// IsLive reports whether the cache is following the realtime stream rather
+// than serving a snapshot
+func (p *MirrorCache[T]) IsLive() bool {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	return p.live
+}
+
+// Restore seeds the cache from a persisted snapshot. The cache counts as
+// synced, so the machine can serve from it, but IsLive stays false until the
+// first live resync, which also evicts anything deleted since the snapshot
+// was taken.
+func (p *MirrorCache[T]) Restore(items []T) {
+	for _, item := range items {
+		p.cache.Upsert(item)
+	}
+
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	if !p.synced {
+		p.synced = true
+		close(p.syncedCh)
+	}
+}
+
+// Snapshot returns every cached record
+func (p *MirrorCache[T]) Snapshot() []T {
+	items := []T{}
+	p.cache.Range(func(item T) bool {
+		items = append(items, item)
+		return true
+	})
+	return items
+}
+
+// Synced is closed once the initial snapshot has been loaded
+func (p *MirrorCache[T]) Synced() <-chan struct{} {
+	return p.syncedCh
+}
+
 func (p *MirrorCache[T]) Range(fn func(item T) bool) {
 	p.cache.Range(fn)
 }
+
+func (p *MirrorCache[T]) Len() int {
+	return p.cache.Len()
+}
+
+func (p *MirrorCache[T]) Get(fieldName string, fieldValue string) (T, bool) {
+	return p.cache.GetByFieldNameAndValue(fieldName, fieldValue)
+}
+
+// Filter returns every item match accepts. It scans the whole cache, so it is
+// for fields that can't be indexed.
+func (p *MirrorCache[T]) Filter(match func(item T) bool) []T {
+	items := []T{}
+	p.cache.Range(func(item T) bool {
+		if match(item) {
+			items = append(items, item)
+		}
+		return true
+	})
+	return items
+}
@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"path/filepath"
+	"pocker/core/services/ubermax/mothership/models"
+	"testing"
+	"time"
+)
+
+func TestFilterFindsEveryInstanceOfAUser(t *testing.T) {
+	instances := newMirrorCache(MirrorCacheConfig[*models.Instance]{
+		CollectionName: "instances",
+		Factory:        models.NewInstance,
+	})
+	owned := []*models.Instance{models.NewInstance(), models.NewInstance(), models.NewInstance()}
+	for i, id := range []string{"a", "b", "c"} {
+		owned[i].Id = id
+		owned[i].Subdomain = id
+		owned[i].Uid = "owner"
+	}
+	owned[2].Uid = "someone-else"
+	instances.Restore(owned)
+
+	got := instances.Filter(func(instance *models.Instance) bool {
+		return instance.Uid == "owner"
+	})
+	if len(got) != 2 {
+		t.Fatalf("Filter() = %d instances, want 2", len(got))
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if _, ok := instances.Get("id", id); !ok {
+			t.Errorf("instance %s lost from the cache", id)
+		}
+	}
+}
+
+func TestRestoredCacheIsSyncedButNotLive(t *testing.T) {
+	instances := newMirrorCache(MirrorCacheConfig[*models.Instance]{
+		CollectionName: "instances",
+		Factory:        models.NewInstance,
+	})
+	instance := models.NewInstance()
+	instance.Id = "a"
+	instances.Restore([]*models.Instance{instance})
+
+	if !instances.IsSynced() {
+		t.Error("restored cache isn't synced")
+	}
+	if instances.IsLive() {
+		t.Error("restored cache is live before any resync")
+	}
+}
+
+func TestStopEndsPeriodicPersistence(t *testing.T) {
+	manager := NewMirrorManager(MirrorManagerConfig{
+		SnapshotPath:     filepath.Join(t.TempDir(), "mirror.json"),
+		SnapshotInterval: time.Millisecond,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.persistPeriodically()
+	}()
+
+	manager.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("persistPeriodically kept running after Stop")
+	}
+}
@@ -0,0 +1,107 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LoadSnapshot restores the caches from the snapshot on disk. It reports
+// whether a snapshot was restored.
+func (p *MirrorManager) LoadSnapshot() bool {
+	if p.config.SnapshotPath == "" {
+		return false
+	}
+
+	data, err := os.ReadFile(p.config.SnapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to read mirror snapshot", "path", p.config.SnapshotPath, "error", err)
+		}
+		return false
+	}
+
+	snapshot := MirrorData{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		slog.Warn("Failed to parse mirror snapshot", "path", p.config.SnapshotPath, "error", err)
+		return false
+	}
+
+	p.instances.Restore(snapshot.Instances)
+	p.users.Restore(snapshot.Users)
+	p.machines.Restore(snapshot.Machines)
+
+	slog.Info("Restored mirror snapshot",
+		"path", p.config.SnapshotPath,
+		"saved_at", snapshot.SavedAt,
+		"instances", len(snapshot.Instances),
+		"users", len(snapshot.Users),
+		"machines", len(snapshot.Machines))
+	return true
+}
+
+// SaveSnapshot writes the caches to disk. The file is replaced atomically so
+// a crash mid-write never leaves a truncated snapshot behind.
+func (p *MirrorManager) SaveSnapshot() error {
+	snapshot := MirrorData{
+		SavedAt:   time.Now(),
+		Instances: p.instances.Snapshot(),
+		Users:     p.users.Snapshot(),
+		Machines:  p.machines.Snapshot(),
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode mirror snapshot: %w", err)
+	}
+
+	dir := filepath.Dir(p.config.SnapshotPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	// Records carry instance secrets, so keep the file private
+	tmp, err := os.CreateTemp(dir, filepath.Base(p.config.SnapshotPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.config.SnapshotPath); err != nil {
+		return fmt.Errorf("failed to replace snapshot file: %w", err)
+	}
+	return nil
+}
+
+// persistPeriodically saves the snapshot on an interval, skipping rounds
+// where the caches have not caught up with the live stream, until Stop
+func (p *MirrorManager) persistPeriodically() {
+	ticker := time.NewTicker(p.config.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stopped:
+			return
+		}
+		if p.IsStale() {
+			continue
+		}
+		if err := p.SaveSnapshot(); err != nil {
+			slog.Warn("Failed to persist mirror snapshot", "path", p.config.SnapshotPath, "error", err)
+			continue
+		}
+		slog.Debug("Persisted mirror snapshot", "path", p.config.SnapshotPath)
+	}
+}
@@ -1,4 +1,10 @@
-package ubermax
+package models
+
+import (
+	"strings"
+
+	"pocker/core/ioc"
+)
 
 type Instance struct {
 	RecordBase
@@ -20,3 +26,28 @@ type Instance struct {
 	Version     string            `json:"version"`
 	Volume      string            `json:"volume"`
 }
+
+var _ ioc.IInstance = (*Instance)(nil)
+
+func NewInstance() *Instance {
+	return &Instance{}
+}
+
+// GetFieldMap leaves out uid: a user owns many instances, and an index keeps
+// one item per value. Find a user's instances with GetInstancesByUserId. The
+// cname is lowercased to match the normalized Host it is looked up by.
+func (i *Instance) GetFieldMap() map[string]string {
+	return map[string]string{
+		"id":        i.Id,
+		"subdomain": i.Subdomain,
+		"cname":     strings.ToLower(i.Cname),
+	}
+}
+
+func (i *Instance) GetUserId() string {
+	return i.Uid
+}
+
+func (i *Instance) GetMachineId() string {
+	return i.MachineId
+}
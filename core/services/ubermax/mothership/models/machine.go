@@ -0,0 +1,29 @@
+package models
+
+import "pocker/core/ioc"
+
+type Machine struct {
+	RecordBase
+	Uuid       string `json:"uuid"`
+	Name       string `json:"name"`
+	Region     string `json:"region"`
+	PrivateUrl string `json:"privateUrl"`
+}
+
+var _ ioc.IMachine = (*Machine)(nil)
+
+func NewMachine() *Machine {
+	return &Machine{}
+}
+
+func (m *Machine) GetFieldMap() map[string]string {
+	return map[string]string{
+		"id":   m.Id,
+		"uuid": m.Uuid,
+		"name": m.Name,
+	}
+}
+
+func (m *Machine) GetPrivateUrl() string {
+	return m.PrivateUrl
+}
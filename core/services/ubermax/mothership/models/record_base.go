@@ -1,4 +1,4 @@
-package ubermax
+package models
 
 type RecordBase struct {
 	CollectionId   string `json:"collectionId"`
@@ -1,4 +1,6 @@
-package ubermax
+package models
+
+import "pocker/core/ioc"
 
 type S3Config struct {
 	Key    string `json:"key"`
@@ -20,3 +22,16 @@ type User struct {
 	Suspension           string   `json:"suspension"`
 	DoubleVerified       bool     `json:"double_verified"`
 }
+
+var _ ioc.IUser = (*User)(nil)
+
+func NewUser() *User {
+	return &User{}
+}
+
+func (u *User) GetFieldMap() map[string]string {
+	return map[string]string{
+		"id":    u.Id,
+		"email": u.Email,
+	}
+}
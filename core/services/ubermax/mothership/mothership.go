@@ -1,21 +1,30 @@
 package mothership
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"pocker/core/ioc"
 	"pocker/core/services/ubermax/mothership/mirror"
+	"pocker/core/services/ubermax/mothership/models"
 	"sync"
+	"time"
 
 	"github.com/pluja/pocketbase"
 )
 
+var ErrNotFound = errors.New("not found in mothership mirror")
+
 type MothershipProviderConfig struct {
 	Url      string
 	Email    string
 	Password string
 	SseDebug bool
+	// SnapshotPath persists the mirror for cold starts while the mothership
+	// is unreachable. Empty disables persistence.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
 }
 
 type MothershipProvider struct {
@@ -69,23 +78,23 @@ func New(config MothershipProviderConfig) *MothershipProvider {
 	provider := MothershipProvider{
 		config: config,
 		client: client,
-		mirror: mirror.NewMirrorManager(mirror.MirrorManagerConfig{
-			Client:   client,
-			SseDebug: config.SseDebug,
-		}),
 	}
+	provider.mirror = mirror.NewMirrorManager(mirror.MirrorManagerConfig{
+		Client:           client,
+		SseDebug:         config.SseDebug,
+		Authenticate:     provider.authenticate,
+		SnapshotPath:     config.SnapshotPath,
+		SnapshotInterval: config.SnapshotInterval,
+	})
 
 	return &provider
 }
 
-func (p *MothershipProvider) ensureMothershipAuthenticated() error {
-	for {
-		err := p.client.Authorize()
-		if err == nil {
-			break
-		}
-		slog.Warn("Failed to authenticate mothership client. Retrying",
-			"error", err)
+// authenticate makes a single attempt to authorize the mothership client.
+// Retrying is left to the mirror streams, which back off between attempts.
+func (p *MothershipProvider) authenticate() error {
+	if err := p.client.Authorize(); err != nil {
+		return fmt.Errorf("failed to authenticate mothership client: %w", err)
 	}
 	slog.Debug("Mothership client authenticated")
 	return nil
@@ -93,18 +102,122 @@ func (p *MothershipProvider) ensureMothershipAuthenticated() error {
 
 func (p *MothershipProvider) Start() {
 	slog.Debug("Starting mothership provider")
-	p.ensureMothershipAuthenticated()
-	p.mirror.Start()
+	// With a snapshot, route from it right away. Without one, the
+	// mirror_synced readiness check keeps traffic away until the first sync,
+	// so a down mothership doesn't stop the machine from listening. Either
+	// way the live stream catches up in the background.
+	p.mirror.LoadSnapshot()
+	go func() {
+		p.authenticateOrWarn()
+		p.mirror.Start()
+	}()
+}
+
+// authenticateOrWarn authenticates before the mirror starts. A failure isn't
+// fatal, the mirror streams re-authenticate as they reconnect.
+func (p *MothershipProvider) authenticateOrWarn() {
+	if err := p.authenticate(); err != nil {
+		slog.Warn("Mothership unavailable, the mirror will keep retrying",
+			"error", err)
+	}
 }
 
-func (p *MothershipProvider) GetInstanceByHostHeader(host string) (ioc.IInstance, error) {
-	return nil, errors.New("not implemented")
+func (p *MothershipProvider) Shutdown(ctx context.Context) error {
+	p.mirror.Stop()
+	return nil
 }
 
-func (p *MothershipProvider) GetUserById(id string) (ioc.IUser, error) {
-	return nil, errors.New("not implemented")
+// IsSynced reports whether the mirror holds a complete copy of the mothership
+func (p *MothershipProvider) IsSynced() bool {
+	return p.mirror.IsSynced()
+}
+
+// IsStale reports whether the mirror is serving a snapshot the live stream
+// has not caught up with yet
+func (p *MothershipProvider) IsStale() bool {
+	return p.mirror.IsStale()
+}
+
+// OnInstanceEvent registers fn to be called for every instance change the
+// mirror applies
+func (p *MothershipProvider) OnInstanceEvent(fn func(action string, instance *models.Instance)) {
+	p.mirror.OnInstanceEvent(func(e *pocketbase.TypedEvent[*models.Instance]) {
+		instance := e.Record
+		if instance == nil {
+			// Deletes may only carry the id
+			instance = models.NewInstance()
+			if e.Fields != nil {
+				instance.Id, _ = (*e.Fields)["id"].(string)
+			}
+		}
+		fn(e.Action, instance)
+	})
+}
+
+// OnUserEvent registers fn to be called with the action and id of every user
+// change the mirror applies
+func (p *MothershipProvider) OnUserEvent(fn func(action string, userId string)) {
+	p.mirror.OnUserEvent(func(e *pocketbase.TypedEvent[*models.User]) {
+		userId := ""
+		if e.Record != nil {
+			userId = e.Record.Id
+		} else if e.Fields != nil {
+			// Deletes may only carry the id
+			userId, _ = (*e.Fields)["id"].(string)
+		}
+		fn(e.Action, userId)
+	})
 }
 
-func (p *MothershipProvider) GetMachineById(id string) (ioc.IMachine, error) {
-	return nil, errors.New("not implemented")
+func (p *MothershipProvider) GetInstanceById(id string) (*models.Instance, error) {
+	instance, ok := p.mirror.GetInstanceById(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: instance id %s", ErrNotFound, id)
+	}
+	return instance, nil
+}
+
+func (p *MothershipProvider) GetInstanceBySubdomain(subdomain string) (*models.Instance, error) {
+	instance, ok := p.mirror.GetInstanceBySubdomain(subdomain)
+	if !ok {
+		return nil, fmt.Errorf("%w: instance subdomain %s", ErrNotFound, subdomain)
+	}
+	return instance, nil
+}
+
+func (p *MothershipProvider) GetInstanceByCname(cname string) (*models.Instance, error) {
+	instance, ok := p.mirror.GetInstanceByCname(cname)
+	if !ok {
+		return nil, fmt.Errorf("%w: instance cname %s", ErrNotFound, cname)
+	}
+	return instance, nil
+}
+
+// GetInstancesByUserId returns every instance the user owns, which may be none
+func (p *MothershipProvider) GetInstancesByUserId(userId string) []*models.Instance {
+	return p.mirror.GetInstancesByUserId(userId)
+}
+
+func (p *MothershipProvider) GetUserById(id string) (*models.User, error) {
+	user, ok := p.mirror.GetUserById(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: user id %s", ErrNotFound, id)
+	}
+	return user, nil
+}
+
+func (p *MothershipProvider) GetMachineById(id string) (*models.Machine, error) {
+	machine, ok := p.mirror.GetMachineById(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: machine id %s", ErrNotFound, id)
+	}
+	return machine, nil
+}
+
+func (p *MothershipProvider) GetMachineByUuid(uuid string) (*models.Machine, error) {
+	machine, ok := p.mirror.GetMachineByUuid(uuid)
+	if !ok {
+		return nil, fmt.Errorf("%w: machine uuid %s", ErrNotFound, uuid)
+	}
+	return machine, nil
 }
@@ -1,28 +1,179 @@
 package ubermax
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"pocker/core/ioc"
+	"pocker/core/services/ubermax/mothership"
+	"pocker/core/services/ubermax/mothership/models"
 )
 
 var _ ioc.IMothershipService = (*Ubermax)(nil)
+var _ ioc.IGracefulService = (*Ubermax)(nil)
+var _ ioc.IReadinessService = (*Ubermax)(nil)
+
+type UbermaxConfig struct {
+	Mothership   mothership.MothershipProviderConfig
+	ApexDomain   string
+	MachinesFile string
+	NeighborPort int
+}
 
 type Ubermax struct {
+	config     UbermaxConfig
+	mothership *mothership.MothershipProvider
+	machines   *machineDirectory
 }
 
-func New() ioc.IMothershipService {
-	provider := &Ubermax{}
+func New(config UbermaxConfig) ioc.IMothershipService {
+	if config.NeighborPort == 0 {
+		config.NeighborPort = 8080
+	}
+	provider := &Ubermax{
+		config:     config,
+		mothership: mothership.New(config.Mothership),
+		machines:   loadMachineDirectory(config.MachinesFile, config.NeighborPort),
+	}
 	return provider
 }
 
 func (p *Ubermax) Start() {
+	p.mothership.Start()
+}
 
+func (p *Ubermax) Shutdown(ctx context.Context) error {
+	return p.mothership.Shutdown(ctx)
 }
 
-func (p *Ubermax) GetDeploymentByIdentifier(identifier string) (ioc.IDeployment, error) {
-	deployment := NewDeployment(
-		&Instance{
-			MachineId: "",
+func (p *Ubermax) ReadinessChecks() []ioc.ReadinessCheck {
+	return []ioc.ReadinessCheck{
+		{
+			Name:     "mirror_synced",
+			Required: true,
+			Check: func(ctx context.Context) error {
+				if !p.mothership.IsSynced() {
+					return errors.New("mothership mirror has not synced yet")
+				}
+				return nil
+			},
+		},
+		{
+			// A mirror restored from disk is good enough to serve, but
+			// operators need to see it may be out of date
+			Name:     "mirror_live",
+			Required: false,
+			Check: func(ctx context.Context) error {
+				if p.mothership.IsStale() {
+					return errors.New("serving from a snapshot until the mothership stream resyncs")
+				}
+				return nil
+			},
 		},
-	)
-	return deployment, nil
+	}
+}
+
+// GetDeploymentByIdentifier resolves a Host header to a deployment, either as
+// a subdomain of the apex domain or as an active custom cname.
+func (p *Ubermax) GetDeploymentByIdentifier(identifier string) (ioc.IDeployment, error) {
+	host := normalizeHost(identifier)
+
+	instance, err := p.getInstanceByHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := p.mothership.GetUserById(instance.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: owner %s of instance %s: %v", ioc.ErrDeploymentNotFound, instance.Uid, instance.Id, err)
+	}
+
+	return NewDeployment(instance, user, p), nil
+}
+
+func (p *Ubermax) GetDeploymentByInstanceId(instanceId string) (ioc.IDeployment, error) {
+	instance, err := p.mothership.GetInstanceById(instanceId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: instance %s: %v", ioc.ErrDeploymentNotFound, instanceId, err)
+	}
+
+	user, err := p.mothership.GetUserById(instance.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: owner %s of instance %s: %v", ioc.ErrDeploymentNotFound, instance.Uid, instance.Id, err)
+	}
+
+	return NewDeployment(instance, user, p), nil
+}
+
+func (p *Ubermax) OnInstanceChange(fn func(action string, instanceId string)) {
+	p.mothership.OnInstanceEvent(func(action string, instance *models.Instance) {
+		fn(action, instance.Id)
+	})
+}
+
+func (p *Ubermax) OnUserChange(fn func(action string, userId string)) {
+	p.mothership.OnUserEvent(fn)
+}
+
+func (p *Ubermax) getInstanceByHost(host string) (*models.Instance, error) {
+	return resolveHost(host, p.config.ApexDomain, p.mothership.GetInstanceBySubdomain, p.mothership.GetInstanceByCname)
+}
+
+func (p *Ubermax) GetInstanceById(id string) (ioc.IInstance, error) {
+	instance, err := p.mothership.GetInstanceById(id)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (p *Ubermax) GetInstanceBySubdomain(subdomain string) (ioc.IInstance, error) {
+	instance, err := p.mothership.GetInstanceBySubdomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (p *Ubermax) GetInstanceByCname(cname string) (ioc.IInstance, error) {
+	instance, err := p.mothership.GetInstanceByCname(cname)
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (p *Ubermax) GetInstancesByUserId(userId string) []ioc.IInstance {
+	instances := []ioc.IInstance{}
+	for _, instance := range p.mothership.GetInstancesByUserId(userId) {
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+func (p *Ubermax) GetUserById(id string) (ioc.IUser, error) {
+	user, err := p.mothership.GetUserById(id)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (p *Ubermax) GetMachineByUuid(uuid string) (ioc.IMachine, error) {
+	machine, err := p.mothership.GetMachineByUuid(uuid)
+	if err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// privateUrlForMachine prefers the privateUrl mirrored from the mothership
+// and falls back to the static machines file.
+func (p *Ubermax) privateUrlForMachine(machineId string) (*url.URL, error) {
+	machine, err := p.mothership.GetMachineByUuid(machineId)
+	if err == nil && machine.GetPrivateUrl() != "" {
+		return url.Parse(machine.GetPrivateUrl())
+	}
+	return p.machines.privateUrl(machineId)
 }
@@ -45,7 +45,7 @@ func (p *IndexedCache[T]) Upsert(item T) {
 		}
 		registry.Store(indexName, item)
 	}
-	slog.Debug("Upserted item", "item", item, "total_indexes", p.registries.Len())
+	slog.Debug("Upserted item", "indexes", item.GetFieldMap(), "total_indexes", p.registries.Len())
 	p.registries.Range(
 		func(registryName string, registry *Map[string, T]) bool {
 			slog.Debug("Registry", "name", registryName, "total_items", registry.Len())
@@ -109,6 +109,13 @@ func (p *IndexedCache[T]) Range(fn func(item T) bool) {
 	})
 }
 
+// Len returns the number of items, as indexed by id
+func (p *IndexedCache[T]) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.getRegistry("id").Len()
+}
+
 func (p *IndexedCache[T]) RLock() {
 	p.mu.RLock()
 }
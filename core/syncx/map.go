@@ -11,8 +11,9 @@ type Map[K comparable, V any] struct {
 }
 
 func (m *Map[K, V]) Delete(key K) {
-	m.m.Delete(key)
-	m.count.Add(-1)
+	if _, loaded := m.m.LoadAndDelete(key); loaded {
+		m.count.Add(-1)
+	}
 }
 func (m *Map[K, V]) Load(key K) (value V, ok bool) {
 	v, ok := m.m.Load(key)
@@ -26,6 +27,7 @@ func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
 	if !loaded {
 		return value, loaded
 	}
+	m.count.Add(-1)
 	return v.(V), loaded
 }
 func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
@@ -39,8 +41,9 @@ func (m *Map[K, V]) Range(f func(key K, value V) bool) {
 	m.m.Range(func(key, value any) bool { return f(key.(K), value.(V)) })
 }
 func (m *Map[K, V]) Store(key K, value V) {
-	m.m.Store(key, value)
-	m.count.Add(1)
+	if _, loaded := m.m.Swap(key, value); !loaded {
+		m.count.Add(1)
+	}
 }
 
 func (m *Map[K, V]) Len() int {
@@ -64,3 +67,11 @@ func (m *Map[K, V]) Values() []V {
 	})
 	return values
 }
+
+func (m *Map[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	deleted = m.m.CompareAndDelete(key, old)
+	if deleted {
+		m.count.Add(-1)
+	}
+	return deleted
+}
@@ -0,0 +1,32 @@
+package syncx
+
+import "testing"
+
+func TestMap_Len(t *testing.T) {
+	m := Map[string, int]{}
+
+	m.Store("a", 1)
+	m.Store("a", 2)
+	m.Store("b", 3)
+	if got := m.Len(); got != 2 {
+		t.Errorf("Len() after overwriting store = %d, want 2", got)
+	}
+
+	m.Delete("missing")
+	if got := m.Len(); got != 2 {
+		t.Errorf("Len() after deleting missing key = %d, want 2", got)
+	}
+
+	m.LoadAndDelete("a")
+	m.Delete("b")
+	if got := m.Len(); got != 0 {
+		t.Errorf("Len() after deleting all keys = %d, want 0", got)
+	}
+
+	m.LoadOrStore("c", 4)
+	m.LoadOrStore("c", 5)
+	m.CompareAndDelete("c", 5)
+	if got := m.Len(); got != 1 {
+		t.Errorf("Len() after failed compare and delete = %d, want 1", got)
+	}
+}
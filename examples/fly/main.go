@@ -10,10 +10,17 @@ import (
 	"os/signal"
 	"pocker"
 	"pocker/core/ioc"
+	"pocker/core/providers/container/in_process"
+	"pocker/core/providers/container/subprocess"
 	"pocker/core/proxy"
+	"pocker/core/services/binaries"
+	"pocker/core/services/lifecycle"
 	"pocker/core/services/machine/fly"
+	"pocker/core/services/port/port_range"
 	"pocker/core/services/ubermax"
+	"pocker/core/services/ubermax/mothership"
 	"syscall"
+	"time"
 
 	"pocker/examples/fly/middleware"
 
@@ -24,15 +31,47 @@ import (
 )
 
 type EnvConfig struct {
-	MothershipUrl               string `env:"MOTHERSHIP_URL,required"`
-	MothershipAdminEmail        string `env:"MOTHERSHIP_ADMIN_EMAIL,required"`
-	MothershipAdminPassword     string `env:"MOTHERSHIP_ADMIN_PASSWORD,required"`
-	DevMode                     bool   `env:"DEV_MODE" envDefault:"false"`
-	LegacyApexDomain            string `env:"LEGACY_APEX_DOMAIN,required"`
-	LegacyOriginUrl             string `env:"LEGACY_ORIGIN_URL,required"`
-	LegacyOriginHelperProxyUrl  string `env:"LEGACY_ORIGIN_HELPER_PROXY_URL,required"`
-	LegacyOriginHelperMachineId string `env:"LEGACY_ORIGIN_HELPER_MACHINE_ID,required"`
-	PHSecret                    string `env:"PH_SECRET,required"`
+	MothershipUrl               string            `env:"MOTHERSHIP_URL,required"`
+	MothershipAdminEmail        string            `env:"MOTHERSHIP_ADMIN_EMAIL,required"`
+	MothershipAdminPassword     string            `env:"MOTHERSHIP_ADMIN_PASSWORD,required"`
+	DevMode                     bool              `env:"DEV_MODE" envDefault:"false"`
+	LegacyApexDomain            string            `env:"LEGACY_APEX_DOMAIN,required"`
+	LegacyOriginUrl             string            `env:"LEGACY_ORIGIN_URL,required"`
+	LegacyOriginHelperProxyUrl  string            `env:"LEGACY_ORIGIN_HELPER_PROXY_URL,required"` // the helper's -private-http listener, see fly.toml
+	LegacyOriginUrls            []string          `env:"LEGACY_ORIGIN_URLS" envSeparator:","`
+	LegacyOriginHelperProxyUrls []string          `env:"LEGACY_ORIGIN_HELPER_PROXY_URLS" envSeparator:","`
+	LegacyBalancing             string            `env:"LEGACY_BALANCING" envDefault:"round_robin"`
+	LegacyTLSCAFile             string            `env:"LEGACY_TLS_CA_FILE"`
+	LegacyTLSServerName         string            `env:"LEGACY_TLS_SERVER_NAME"`
+	LegacyTLSPinnedKeys         []string          `env:"LEGACY_TLS_PINNED_KEYS" envSeparator:","`
+	LegacyTLSInsecure           bool              `env:"LEGACY_TLS_INSECURE_SKIP_VERIFY" envDefault:"false"`
+	LegacyOriginHelperMachineId string            `env:"LEGACY_ORIGIN_HELPER_MACHINE_ID,required"`
+	PHSecret                    string            `env:"PH_SECRET,required"`
+	RateLimitTiers              map[string]string `env:"RATE_LIMIT_TIERS" envSeparator:"," envKeyValSeparator:":"`
+	RateLimitDefault            string            `env:"RATE_LIMIT_DEFAULT" envDefault:"0"`
+	RateLimitPerClientIp        bool              `env:"RATE_LIMIT_PER_CLIENT_IP" envDefault:"false"`
+	MaxInFlightPerInstance      int               `env:"MAX_IN_FLIGHT_PER_INSTANCE" envDefault:"50"`
+	MaxQueuePerInstance         int               `env:"MAX_QUEUE_PER_INSTANCE" envDefault:"100"`
+	InstanceQueueTimeout        time.Duration     `env:"INSTANCE_QUEUE_TIMEOUT" envDefault:"10s"`
+	MaxStreamsPerInstance       int               `env:"MAX_STREAMS_PER_INSTANCE" envDefault:"200"`
+	TrustedProxyCidrs           []string          `env:"TRUSTED_PROXY_CIDRS" envSeparator:"," envDefault:"fdaa::/16"`
+	ApexDomain                  string            `env:"APEX_DOMAIN"`
+	MirrorSnapshotPath          string            `env:"MIRROR_SNAPSHOT_PATH" envDefault:"/data/mirror.json"`
+	MachinesFile                string            `env:"MACHINES_FILE" envDefault:"/machines.json"`
+	DefaultIdleTtl              time.Duration     `env:"DEFAULT_IDLE_TTL" envDefault:"5m"`
+	LegacyIdleTimeout           time.Duration     `env:"LEGACY_IDLE_TIMEOUT" envDefault:"15m"`
+	LocalIdleTimeout            time.Duration     `env:"LOCAL_IDLE_TIMEOUT" envDefault:"15m"`
+	NeighborIdleTimeout         time.Duration     `env:"NEIGHBOR_IDLE_TIMEOUT" envDefault:"15m"`
+	ShutdownTimeout             time.Duration     `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	DataRoot                    string            `env:"DATA_ROOT" envDefault:"/data/instances"`
+	ContainerProvider           string            `env:"CONTAINER_PROVIDER" envDefault:"in_process"`
+	PocketBaseBinary            string            `env:"POCKETBASE_BINARY" envDefault:"/usr/local/bin/pocketbase"`
+	PocketBaseBinariesDir       string            `env:"POCKETBASE_BINARIES_DIR" envDefault:"/data/binaries"`
+	PocketBaseMirrorUrl         string            `env:"POCKETBASE_MIRROR_URL" envDefault:"https://github.com/pocketbase/pocketbase/releases/download"`
+	PocketBaseDigests           map[string]string `env:"POCKETBASE_DIGESTS" envSeparator:"," envKeyValSeparator:":"`
+	CgroupRoot                  string            `env:"CGROUP_ROOT"`
+	CgroupLimitTiers            map[string]string `env:"CGROUP_LIMIT_TIERS" envSeparator:"," envKeyValSeparator:":"`
+	CgroupLimitDefault          string            `env:"CGROUP_LIMIT_DEFAULT"`
 }
 
 func main() {
@@ -49,34 +88,96 @@ func main() {
 
 	// Add HTTP port flag
 	httpAddr := flag.String("http", ":8080", "the HTTP server address")
+	privateHttpAddr := flag.String("private-http", "fly-local-6pn:9090", "the private HTTP server address for metrics and readiness details")
 	flag.Parse()
 
 	// Bootstrap providers
 	machineInfoService := fly.New()
 	ioc.RegisterMachineInfoService(machineInfoService)
 
-	mothershipService := ubermax.New()
+	mothershipService := ubermax.New(ubermax.UbermaxConfig{
+		Mothership: mothership.MothershipProviderConfig{
+			Url:          cfg.MothershipUrl,
+			Email:        cfg.MothershipAdminEmail,
+			Password:     cfg.MothershipAdminPassword,
+			SseDebug:     cfg.DevMode,
+			SnapshotPath: cfg.MirrorSnapshotPath,
+		},
+		ApexDomain:   cfg.ApexDomain,
+		MachinesFile: cfg.MachinesFile,
+	})
 	ioc.RegisterMothershipService(mothershipService)
 
+	portService := port_range.New(port_range.FixedPortRangeProviderConfig{})
+	ioc.RegisterPortService(portService)
+
+	containerService := newContainerService(cfg)
+	ioc.RegisterContainerService(containerService)
+
 	machineInfoService.Start()
 	mothershipService.Start()
+	portService.Start()
+	containerService.Start()
+
+	// Stop or restart local containers as their instance records change
+	lifecycleController := lifecycle.New(lifecycle.LifecycleControllerConfig{})
+	ioc.Ioc().Register("lifecycleController", lifecycleController)
+	lifecycleController.Start()
 
 	// And begin proxy
 	displayFlyInfo()
 
+	rateLimitTiers, err := pockerMiddleware.ParseRateLimitTiers(cfg.RateLimitTiers)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid RATE_LIMIT_TIERS: %v", err))
+	}
+	rateLimitDefault, err := pockerMiddleware.ParseRateLimit(cfg.RateLimitDefault)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid RATE_LIMIT_DEFAULT: %v", err))
+	}
+
 	pocker := pocker.NewPocker(pocker.PockerConfig{
 		ProxyConfig: proxy.ProxyConfig{
-			ListenAddr: *httpAddr,
+			ListenAddr:        *httpAddr,
+			PrivateListenAddr: *privateHttpAddr,
 			Middlewares: []gin.HandlerFunc{
 				middleware.FlyHeadersMiddleware(),
 			},
+			PockerMiddlewares: []gin.HandlerFunc{
+				pockerMiddleware.RateLimitMiddleware(pockerMiddleware.RateLimitConfig{
+					Tiers:       rateLimitTiers,
+					Default:     rateLimitDefault,
+					PerClientIp: cfg.RateLimitPerClientIp,
+				}),
+				pockerMiddleware.ConcurrencyLimitMiddleware(pockerMiddleware.ConcurrencyLimitConfig{
+					MaxInFlight:  cfg.MaxInFlightPerInstance,
+					MaxQueue:     cfg.MaxQueuePerInstance,
+					QueueTimeout: cfg.InstanceQueueTimeout,
+					MaxStreams:   cfg.MaxStreamsPerInstance,
+				}),
+			},
+			HeaderSanitizerConfig: pockerMiddleware.HeaderSanitizerConfig{
+				TrustedProxies: cfg.TrustedProxyCidrs,
+			},
 			DevMode: cfg.DevMode,
 			PockerMiddlewareConfig: pockerMiddleware.PockerMiddlewareConfig{
 				LegacyOriginHelperMachineId: cfg.LegacyOriginHelperMachineId,
 				LegacyOriginHelperProxyUrl:  cfg.LegacyOriginHelperProxyUrl,
 				LegacyOriginUrl:             cfg.LegacyOriginUrl,
 				LegacyApexDomain:            cfg.LegacyApexDomain,
-				PHSecret:                    cfg.PHSecret,
+				LegacyOriginUrls:            cfg.LegacyOriginUrls,
+				LegacyOriginHelperProxyUrls: cfg.LegacyOriginHelperProxyUrls,
+				LegacyBalancing:             cfg.LegacyBalancing,
+				LegacyTLS: pockerMiddleware.UpstreamTLSConfig{
+					CAFile:             cfg.LegacyTLSCAFile,
+					ServerName:         cfg.LegacyTLSServerName,
+					PinnedKeys:         cfg.LegacyTLSPinnedKeys,
+					InsecureSkipVerify: cfg.LegacyTLSInsecure,
+				},
+				LegacyIdleTimeout:   cfg.LegacyIdleTimeout,
+				LocalIdleTimeout:    cfg.LocalIdleTimeout,
+				NeighborIdleTimeout: cfg.NeighborIdleTimeout,
+				PHSecret:            cfg.PHSecret,
 			},
 		},
 	})
@@ -84,6 +185,13 @@ func main() {
 
 	<-ctx.Done()
 	fmt.Println("\nShutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := pocker.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown incomplete", "error", err)
+		os.Exit(1)
+	}
 }
 
 func displayFlyInfo() {
@@ -94,3 +202,44 @@ func displayFlyInfo() {
 		info.AppName(),
 		info.PrivateIp())
 }
+
+// newContainerService picks where instances run: inside this process, or as
+// one PocketBase child process each, running the version the instance asks
+// for
+func newContainerService(cfg EnvConfig) ioc.IContainerService {
+	switch cfg.ContainerProvider {
+	case "in_process":
+		return in_process.New(in_process.ContainerProviderConfig{
+			DevMode:        cfg.DevMode,
+			DataRoot:       cfg.DataRoot,
+			DefaultIdleTtl: cfg.DefaultIdleTtl,
+		})
+	case "subprocess":
+		limitTiers, err := subprocess.ParseResourceLimitTiers(cfg.CgroupLimitTiers)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid CGROUP_LIMIT_TIERS: %v", err))
+		}
+		limitDefault, err := subprocess.ParseResourceLimits(cfg.CgroupLimitDefault)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid CGROUP_LIMIT_DEFAULT: %v", err))
+		}
+		return subprocess.New(subprocess.ContainerProviderConfig{
+			DevMode:    cfg.DevMode,
+			DataRoot:   cfg.DataRoot,
+			BinaryPath: cfg.PocketBaseBinary,
+			Binaries: binaries.New(binaries.BinaryCacheConfig{
+				Dir:       cfg.PocketBaseBinariesDir,
+				MirrorUrl: cfg.PocketBaseMirrorUrl,
+				Digests:   cfg.PocketBaseDigests,
+			}),
+			DefaultIdleTtl: cfg.DefaultIdleTtl,
+			Cgroups: subprocess.CgroupConfig{
+				Root:    cfg.CgroupRoot,
+				Tiers:   limitTiers,
+				Default: limitDefault,
+			},
+		})
+	default:
+		panic(fmt.Sprintf("Unknown CONTAINER_PROVIDER %q", cfg.ContainerProvider))
+	}
+}
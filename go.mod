@@ -10,6 +10,7 @@ replace (
 
 require (
 	github.com/caarlos0/env/v11 v11.2.2
+	github.com/dop251/goja v0.0.0-20241009100908-5f46f2705ca3
 	github.com/gin-gonic/gin v1.10.0
 	github.com/joho/godotenv v1.5.1
 	github.com/pluja/pocketbase v0.1.0
@@ -49,7 +50,6 @@ require (
 	github.com/domodwyer/mailyak/v3 v3.6.2 // indirect
 	github.com/donovanhide/eventsource v0.0.0-20210830082556-c59027999da0 // indirect
 	github.com/dop251/base64dec v0.0.0-20231022112746-c6c9f9a96217 // indirect
-	github.com/dop251/goja v0.0.0-20241009100908-5f46f2705ca3 // indirect
 	github.com/dop251/goja_nodejs v0.0.0-20240728170619-29b559befffc // indirect
 	github.com/duke-git/lancet/v2 v2.3.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
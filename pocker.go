@@ -1,6 +1,12 @@
 package pocker
 
-import "pocker/core/proxy"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"pocker/core/ioc"
+	"pocker/core/proxy"
+)
 
 type PockerConfig struct {
 	ProxyConfig proxy.ProxyConfig
@@ -8,15 +14,34 @@ type PockerConfig struct {
 
 type Pocker struct {
 	PockerConfig
+	server *proxy.Proxy
 }
 
 func NewPocker(cfg PockerConfig) *Pocker {
 	return &Pocker{
 		PockerConfig: cfg,
+		server:       proxy.NewProxy(cfg.ProxyConfig),
 	}
 }
 
 func (p *Pocker) Start() {
-	server := proxy.NewProxy(p.ProxyConfig)
-	server.Start()
+	p.server.Start()
+}
+
+// Shutdown drains the HTTP server first so no request is cut off, then stops
+// every service (containers, mirror streams) within the same deadline
+func (p *Pocker) Shutdown(ctx context.Context) error {
+	slog.Info("Draining main server")
+	serverErr := p.server.Shutdown(ctx)
+	if serverErr != nil {
+		slog.Warn("Main server did not drain cleanly", "error", serverErr)
+	}
+
+	slog.Info("Stopping services")
+	servicesErr := ioc.Ioc().Shutdown(ctx)
+	if servicesErr != nil {
+		slog.Warn("Services did not stop cleanly", "error", servicesErr)
+	}
+
+	return errors.Join(serverErr, servicesErr)
 }